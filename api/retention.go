@@ -0,0 +1,128 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/maoxs2/ergoPool/util"
+)
+
+// Rounds checked per purge run, the rest is left for next runs
+const expiredRoundsBatch = 500
+
+type RetentionConfig struct {
+	Enabled bool `json:"enabled"`
+	DryRun  bool `json:"dryRun"`
+	// Drop round shares that long after block maturity
+	RoundShares string `json:"roundShares"`
+	// Write round shares to this directory before dropping them
+	Archive string `json:"archive"`
+	// Keep that many most recent rows in every payments list
+	Payments int64 `json:"payments"`
+	// Delete miners without balance that have no shares for that long
+	InactiveMiners string `json:"inactiveMiners"`
+}
+
+func (s *ApiServer) purgeRetention() {
+	cfg := &s.config.Retention
+	start := time.Now()
+	now := util.MakeTimestamp() / 1000
+	prefix := "Purged"
+	if cfg.DryRun {
+		prefix = "Dry run, would purge"
+	}
+
+	if len(cfg.RoundShares) > 0 {
+		before := now - int64(util.MustParseDuration(cfg.RoundShares)/time.Second)
+		blocks, err := s.backend.GetExpiredRounds(before, expiredRoundsBatch)
+		if err != nil {
+			log.Println("Failed to get expired rounds from backend:", err)
+			return
+		}
+		purged := 0
+		// Rounds are purged in height order, failed one stops the run to be retried next time
+		for _, block := range blocks {
+			if cfg.DryRun {
+				log.Printf("%s round shares %v:%v", prefix, block.RoundHeight, block.RoundId())
+				purged++
+				continue
+			}
+			if len(cfg.Archive) > 0 {
+				err = s.archiveRound(block.RoundHeight, block.RoundId())
+				if err != nil {
+					log.Printf("Failed to archive round %v:%v, keeping it: %v", block.RoundHeight, block.RoundId(), err)
+					break
+				}
+			}
+			err = s.backend.PurgeRound(block)
+			if err != nil {
+				log.Printf("Failed to purge round %v:%v: %v", block.RoundHeight, block.RoundId(), err)
+				break
+			}
+			purged++
+		}
+		log.Printf("%s %v of %v expired rounds", prefix, purged, len(blocks))
+	}
+
+	if cfg.Payments > 0 {
+		n, err := s.backend.CompactPayments(cfg.Payments, cfg.DryRun)
+		if err != nil {
+			log.Println("Failed to compact payments in backend:", err)
+		} else {
+			log.Printf("%s %v payment rows beyond %v per list", prefix, n, cfg.Payments)
+		}
+	}
+
+	if len(cfg.InactiveMiners) > 0 {
+		before := now - int64(util.MustParseDuration(cfg.InactiveMiners)/time.Second)
+		logins, err := s.backend.GetInactiveMiners(before)
+		if err != nil {
+			log.Println("Failed to get inactive miners from backend:", err)
+			return
+		}
+		purged := 0
+		for _, login := range logins {
+			if cfg.DryRun {
+				log.Printf("%s inactive miner %s", prefix, login)
+				purged++
+				continue
+			}
+			deleted, err := s.backend.DeleteMiner(login, before)
+			if err != nil {
+				log.Printf("Failed to delete inactive miner %s: %v", login, err)
+				continue
+			}
+			if deleted {
+				purged++
+			}
+		}
+		log.Printf("%s %v inactive miners", prefix, purged)
+	}
+	log.Printf("Retention policy applied, elapsed time %v", time.Since(start))
+}
+
+func (s *ApiServer) archiveRound(height int64, id string) error {
+	shares, err := s.backend.GetRoundShares(height, id)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"height": height,
+		"id":     id,
+		"shares": shares,
+	})
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(s.config.Retention.Archive, 0700)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(s.config.Retention.Archive, fmt.Sprintf("round-%v-%s.json", height, id))
+	return ioutil.WriteFile(name, data, 0600)
+}
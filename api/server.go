@@ -1,8 +1,11 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
+	"math/big"
 	"net/http"
 	"sort"
 	"sync"
@@ -18,25 +21,53 @@ import (
 type ApiConfig struct {
 	Enabled              bool   `json:"enabled"`
 	Listen               string `json:"listen"`
+	AdminListen          string `json:"adminListen"`
 	StatsCollectInterval string `json:"statsCollectInterval"`
 	HashrateWindow       string `json:"hashrateWindow"`
 	HashrateLargeWindow  string `json:"hashrateLargeWindow"`
 	LuckWindow           []int  `json:"luckWindow"`
 	Payments             int64  `json:"payments"`
 	Blocks               int64  `json:"blocks"`
+	Balances             int64  `json:"balances"`
 	PurgeOnly            bool   `json:"purgeOnly"`
 	PurgeInterval        string `json:"purgeInterval"`
+
+	Retention RetentionConfig `json:"retention"`
 }
 
 type ApiServer struct {
-	config              *ApiConfig
-	backend             *storage.RedisClient
-	hashrateWindow      time.Duration
-	hashrateLargeWindow time.Duration
-	stats               atomic.Value
-	miners              map[string]*Entry
-	minersMu            sync.RWMutex
-	statsIntv           time.Duration
+	config        *ApiConfig
+	backend       *storage.RedisClient
+	windows       atomic.Value
+	configVersion atomic.Value
+	stats         atomic.Value
+	miners        map[string]*Entry
+	minersMu      sync.RWMutex
+	statsIntv     time.Duration
+	srv           *http.Server
+	adminSrv      *http.Server
+	quit          chan struct{}
+}
+
+// Stats windows, replaced as a whole on config reload
+type statsWindows struct {
+	hashrate      time.Duration
+	hashrateLarge time.Duration
+	luck          []int
+}
+
+func newStatsWindows(cfg *ApiConfig) (*statsWindows, error) {
+	hashrateWindow, err := time.ParseDuration(cfg.HashrateWindow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hashrate window: %v", err)
+	}
+	hashrateLargeWindow, err := time.ParseDuration(cfg.HashrateLargeWindow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid large hashrate window: %v", err)
+	}
+	luck := append([]int(nil), cfg.LuckWindow...)
+	sort.Ints(luck)
+	return &statsWindows{hashrate: hashrateWindow, hashrateLarge: hashrateLargeWindow, luck: luck}, nil
 }
 
 type Entry struct {
@@ -45,15 +76,25 @@ type Entry struct {
 }
 
 func NewApiServer(cfg *ApiConfig, backend *storage.RedisClient) *ApiServer {
-	hashrateWindow := util.MustParseDuration(cfg.HashrateWindow)
-	hashrateLargeWindow := util.MustParseDuration(cfg.HashrateLargeWindow)
-	return &ApiServer{
-		config:              cfg,
-		backend:             backend,
-		hashrateWindow:      hashrateWindow,
-		hashrateLargeWindow: hashrateLargeWindow,
-		miners:              make(map[string]*Entry),
+	windows, err := newStatsWindows(cfg)
+	if err != nil {
+		log.Fatalf("Failed to set up API: %v", err)
 	}
+	s := &ApiServer{
+		config:  cfg,
+		backend: backend,
+		miners:  make(map[string]*Entry),
+		quit:    make(chan struct{}),
+	}
+	s.windows.Store(windows)
+	s.configVersion.Store("")
+	if !cfg.PurgeOnly {
+		s.srv = s.newServer()
+		if len(cfg.AdminListen) > 0 {
+			s.adminSrv = s.newAdminServer()
+		}
+	}
+	return s
 }
 
 func (s *ApiServer) Start() {
@@ -71,8 +112,6 @@ func (s *ApiServer) Start() {
 	purgeTimer := time.NewTimer(purgeIntv)
 	log.Printf("Set purge interval to %v", purgeIntv)
 
-	sort.Ints(s.config.LuckWindow)
-
 	if s.config.PurgeOnly {
 		s.purgeStale()
 	} else {
@@ -83,6 +122,10 @@ func (s *ApiServer) Start() {
 	go func() {
 		for {
 			select {
+			case <-s.quit:
+				statsTimer.Stop()
+				purgeTimer.Stop()
+				return
 			case <-statsTimer.C:
 				if !s.config.PurgeOnly {
 					s.collectStats()
@@ -95,23 +138,74 @@ func (s *ApiServer) Start() {
 		}
 	}()
 
+	if s.adminSrv != nil {
+		log.Printf("Starting admin API on %v", s.config.AdminListen)
+		go listen("admin API", s.adminSrv)
+	}
 	if !s.config.PurgeOnly {
-		s.listen()
+		listen("API", s.srv)
+	}
+}
+
+// Reload applies hashrate and luck windows starting from next stats collection
+func (s *ApiServer) Reload(cfg *ApiConfig) error {
+	windows, err := newStatsWindows(cfg)
+	if err != nil {
+		return err
+	}
+	s.windows.Store(windows)
+	log.Printf("API reloaded: hashrate windows %v and %v", windows.hashrate, windows.hashrateLarge)
+	return nil
+}
+
+func (s *ApiServer) SetConfigVersion(version string) {
+	s.configVersion.Store(version)
+}
+
+func (s *ApiServer) statsWindows() *statsWindows {
+	return s.windows.Load().(*statsWindows)
+}
+
+// Shutdown stops stats timers and waits for active API requests
+func (s *ApiServer) Shutdown(ctx context.Context) error {
+	log.Println("Stopping API")
+	close(s.quit)
+	if s.adminSrv != nil {
+		if err := s.adminSrv.Shutdown(ctx); err != nil {
+			log.Printf("Admin API did not close in time: %v", err)
+		}
+	}
+	if s.srv == nil {
+		return nil
+	}
+	return s.srv.Shutdown(ctx)
+}
+
+func listen(name string, srv *http.Server) {
+	err := srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Failed to start %s: %v", name, err)
 	}
 }
 
-func (s *ApiServer) listen() {
+func (s *ApiServer) newServer() *http.Server {
 	r := mux.NewRouter()
 	r.HandleFunc("/api/stats", s.StatsIndex)
 	r.HandleFunc("/api/miners", s.MinersIndex)
 	r.HandleFunc("/api/blocks", s.BlocksIndex)
 	r.HandleFunc("/api/payments", s.PaymentsIndex)
+	r.HandleFunc("/api/balances", s.BalancesIndex)
 	r.HandleFunc("/api/accounts/{login}", s.AccountIndex)
 	r.NotFoundHandler = http.HandlerFunc(notFound)
-	err := http.ListenAndServe(s.config.Listen, r)
-	if err != nil {
-		log.Fatalf("Failed to start API: %v", err)
-	}
+	return &http.Server{Addr: s.config.Listen, Handler: r}
+}
+
+// Admin routes expose pool internals, listener must not be reachable by miners
+func (s *ApiServer) newAdminServer() *http.Server {
+	r := mux.NewRouter()
+	r.HandleFunc("/api/bans", s.BansIndex)
+	r.NotFoundHandler = http.HandlerFunc(notFound)
+	return &http.Server{Addr: s.config.AdminListen, Handler: r}
 }
 
 func notFound(w http.ResponseWriter, r *http.Request) {
@@ -123,28 +217,45 @@ func notFound(w http.ResponseWriter, r *http.Request) {
 
 func (s *ApiServer) purgeStale() {
 	start := time.Now()
-	total, err := s.backend.FlushStaleStats(s.hashrateWindow, s.hashrateLargeWindow)
+	total, err := s.backend.FlushStaleStats()
 	if err != nil {
 		log.Println("Failed to purge stale data from backend:", err)
 	} else {
 		log.Printf("Purged stale stats from backend, %v shares affected, elapsed time %v", total, time.Since(start))
 	}
+	n, err := s.backend.PurgeExpiredBans()
+	if err != nil {
+		log.Println("Failed to purge expired bans from backend:", err)
+	} else if n > 0 {
+		log.Printf("Purged %v expired bans", n)
+	}
+	if s.config.Retention.Enabled {
+		s.purgeRetention()
+	}
 }
 
 func (s *ApiServer) collectStats() {
 	start := time.Now()
-	stats, err := s.backend.CollectStats(s.hashrateWindow, s.config.Blocks, s.config.Payments)
+	windows := s.statsWindows()
+	stats, err := s.backend.CollectStats(windows.hashrate, s.config.Blocks, s.config.Payments)
 	if err != nil {
 		log.Printf("Failed to fetch stats from backend: %v", err)
 		return
 	}
-	if len(s.config.LuckWindow) > 0 {
-		stats["luck"], err = s.backend.CollectLuckStats(s.config.LuckWindow)
+	if len(windows.luck) > 0 {
+		stats["luck"], err = s.backend.CollectLuckStats(windows.luck)
 		if err != nil {
 			log.Printf("Failed to fetch luck stats from backend: %v", err)
 			return
 		}
 	}
+	if s.config.Balances > 0 {
+		stats["balances"], err = s.backend.GetTopBalances(s.config.Balances)
+		if err != nil {
+			log.Printf("Failed to fetch top balances from backend: %v", err)
+			return
+		}
+	}
 	s.stats.Store(stats)
 	log.Printf("Stats collection finished %s", time.Since(start))
 }
@@ -161,6 +272,7 @@ func (s *ApiServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Failed to get nodes stats from backend: %v", err)
 	}
 	reply["nodes"] = nodes
+	reply["configVersion"] = s.configVersion.Load()
 
 	stats := s.getStats()
 	if stats != nil {
@@ -243,6 +355,48 @@ func (s *ApiServer) PaymentsIndex(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *ApiServer) BalancesIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	reply := make(map[string]interface{})
+	stats := s.getStats()
+	if stats != nil {
+		reply["balances"] = stats["balances"]
+	}
+
+	err := json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
+
+func (s *ApiServer) BansIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	bans, err := s.backend.GetActiveBans()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to fetch bans from backend: %v", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	reply := make(map[string]interface{})
+	reply["now"] = util.MakeTimestamp()
+	reply["bans"] = bans
+	reply["bansTotal"] = len(bans)
+
+	err = json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
+
 func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -274,7 +428,18 @@ func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
 			log.Printf("Failed to fetch stats from backend: %v", err)
 			return
 		}
-		workers, err := s.backend.CollectWorkersStats(s.hashrateWindow, s.hashrateLargeWindow, login)
+		// Expected solo effort is network difficulty worth of shares
+		if soloShares, _ := stats["soloShares"].(int64); soloShares > 0 {
+			diff, err := s.backend.GetNetworkDifficulty()
+			if err != nil {
+				log.Printf("Failed to fetch network difficulty from backend: %v", err)
+			} else if diff != nil {
+				effort, _ := new(big.Rat).SetFrac(big.NewInt(soloShares), diff).Float64()
+				stats["soloEffort"] = effort
+			}
+		}
+		windows := s.statsWindows()
+		workers, err := s.backend.CollectWorkersStats(windows.hashrate, windows.hashrateLarge, login)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			log.Printf("Failed to fetch stats from backend: %v", err)
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+
+	"github.com/maoxs2/ergoPool/storage"
+)
+
+// Maintenance commands run instead of pool modules: ergoPool <command> [config.json] [args...]
+var commands = map[string]func(args []string) int{
+	"migrate":  migrateCommand,
+	"backup":   backupCommand,
+	"restore":  restoreCommand,
+	"verify":   verifyCommand,
+	"validate": validateCommand,
+}
+
+func parseCommand(args []string) (func([]string) int, []string) {
+	if len(args) > 0 {
+		if command, ok := commands[args[0]]; ok {
+			return command, args[1:]
+		}
+	}
+	return nil, args
+}
+
+func validateCommand(args []string) int {
+	problems := validateConfig(&cfg)
+	for _, problem := range problems {
+		log.Println(problem)
+	}
+	if len(problems) > 0 {
+		log.Printf("Config has %v problems", len(problems))
+		return 1
+	}
+	log.Println("Config is valid")
+	return 0
+}
+
+func migrateCommand(args []string) int {
+	log.Println("Converting block and payment rows to JSON, unlocker and payouts must be stopped")
+	result, err := backend.MigrateRows()
+	for key, n := range result {
+		log.Printf("Converted %v rows in %s", n, key)
+	}
+	if err != nil {
+		log.Printf("Migration failed: %v", err)
+		return 1
+	}
+	log.Println("Migration complete")
+	return 0
+}
+
+func backupCommand(args []string) int {
+	if len(args) < 2 {
+		log.Println("Usage: backup <config.json> <backup.json>")
+		return 2
+	}
+	backup, err := backend.Export()
+	if err != nil {
+		log.Printf("Backup failed: %v", err)
+		return 1
+	}
+	f, err := os.OpenFile(args[1], os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Backup failed: %v", err)
+		return 1
+	}
+	defer f.Close()
+	err = json.NewEncoder(f).Encode(backup)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		log.Printf("Backup failed: %v", err)
+		return 1
+	}
+	log.Printf("Saved %v keys to %s, checksum %s", len(backup.Keys), args[1], backup.Checksum)
+	return 0
+}
+
+func restoreCommand(args []string) int {
+	backup := readBackup(args)
+	if backup == nil {
+		return 1
+	}
+	err := backend.Restore(backup)
+	if err != nil {
+		log.Printf("Restore failed: %v", err)
+		return 1
+	}
+	log.Printf("Restored %v keys from %s", len(backup.Keys), args[1])
+	return 0
+}
+
+func verifyCommand(args []string) int {
+	backup := readBackup(args)
+	if backup == nil {
+		return 1
+	}
+	diff, err := backend.Diff(backup)
+	if err != nil {
+		log.Printf("Verify failed: %v", err)
+		return 1
+	}
+	for _, line := range diff {
+		log.Println(line)
+	}
+	if len(diff) > 0 {
+		log.Printf("Backup %s differs from database in %v keys", args[1], len(diff))
+		return 1
+	}
+	log.Printf("Backup %s matches database", args[1])
+	return 0
+}
+
+func readBackup(args []string) *storage.Backup {
+	if len(args) < 2 {
+		log.Println("Usage: restore|verify <config.json> <backup.json>")
+		return nil
+	}
+	f, err := os.Open(args[1])
+	if err != nil {
+		log.Printf("Failed to open backup: %v", err)
+		return nil
+	}
+	defer f.Close()
+
+	var backup storage.Backup
+	err = json.NewDecoder(f).Decode(&backup)
+	if err == nil {
+		err = backup.Verify()
+	}
+	if err != nil {
+		log.Printf("Invalid backup %s: %v", args[1], err)
+		return nil
+	}
+	return &backup
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/maoxs2/ergoPool/proxy"
+)
+
+// Any config field can be set by environment variable named after its JSON path,
+// e.g. ERGOPOOL_REDIS_PASSWORD, ERGOPOOL_PAYOUTS_APIKEY or ERGOPOOL_UPSTREAM_0_APIKEY.
+// Strings are taken as is, other values are parsed as JSON, e.g. ERGOPOOL_API_LUCKWINDOW=[64,128].
+const envPrefix = "ERGOPOOL"
+
+func overrideFromEnv(cfg *proxy.Config) error {
+	applied, err := applyEnvOverrides(reflect.ValueOf(cfg).Elem(), envPrefix)
+	if err != nil {
+		return err
+	}
+	if len(applied) > 0 {
+		log.Printf("Config overridden by environment: %s", strings.Join(applied, ", "))
+	}
+	return nil
+}
+
+// Returns names of applied variables, never their values
+func applyEnvOverrides(v reflect.Value, name string) ([]string, error) {
+	var applied []string
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := strings.Split(field.Tag.Get("json"), ",")[0]
+			if len(field.PkgPath) > 0 || tag == "-" {
+				continue
+			}
+			if len(tag) == 0 {
+				tag = field.Name
+			}
+			names, err := applyEnvOverrides(v.Field(i), name+"_"+strings.ToUpper(tag))
+			applied = append(applied, names...)
+			if err != nil {
+				return applied, err
+			}
+		}
+		return applied, nil
+	case reflect.Slice:
+		// Elements of struct lists are addressed by index, other lists are set as a whole
+		if v.Type().Elem().Kind() == reflect.Struct {
+			for i := 0; i < v.Len(); i++ {
+				names, err := applyEnvOverrides(v.Index(i), name+"_"+strconv.Itoa(i))
+				applied = append(applied, names...)
+				if err != nil {
+					return applied, err
+				}
+			}
+			return applied, nil
+		}
+	}
+
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, nil
+	}
+	if v.Kind() == reflect.String {
+		v.SetString(value)
+	} else if err := json.Unmarshal([]byte(value), v.Addr().Interface()); err != nil {
+		return nil, fmt.Errorf("invalid value of %s: %v", name, err)
+	}
+	return []string{name}, nil
+}
@@ -0,0 +1,152 @@
+package ergo
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+type NetworkType byte
+
+const (
+	Mainnet NetworkType = 0x00
+	Testnet NetworkType = 0x10
+)
+
+func (n NetworkType) String() string {
+	switch n {
+	case Mainnet:
+		return "mainnet"
+	case Testnet:
+		return "testnet"
+	}
+	return fmt.Sprintf("unknown(%#x)", byte(n))
+}
+
+type AddressType byte
+
+const (
+	P2PK AddressType = 1
+	P2SH AddressType = 2
+	P2S  AddressType = 3
+)
+
+func (t AddressType) String() string {
+	switch t {
+	case P2PK:
+		return "P2PK"
+	case P2SH:
+		return "P2SH"
+	case P2S:
+		return "P2S"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(t))
+}
+
+const (
+	checksumLength = 4
+	p2pkLength     = 33
+	p2shLength     = 24
+)
+
+var (
+	ErrMalformedAddress = errors.New("malformed address")
+	ErrChecksum         = errors.New("invalid address checksum")
+)
+
+type Address struct {
+	Network NetworkType
+	Type    AddressType
+	// Compressed public key for P2PK, script hash for P2SH and serialized script for P2S
+	Content []byte
+}
+
+// ParseAddress decodes Base58 address and verifies its prefix, content length and Blake2b256 checksum
+func ParseAddress(s string) (*Address, error) {
+	data, err := decodeBase58(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 1+checksumLength+1 {
+		return nil, ErrMalformedAddress
+	}
+	body, checksum := data[:len(data)-checksumLength], data[len(data)-checksumLength:]
+	hash := blake2b.Sum256(body)
+	if !bytes.Equal(hash[:checksumLength], checksum) {
+		return nil, ErrChecksum
+	}
+
+	addr := &Address{
+		Network: NetworkType(body[0] & 0xf0),
+		Type:    AddressType(body[0] & 0x0f),
+		Content: body[1:],
+	}
+	if addr.Network != Mainnet && addr.Network != Testnet {
+		return nil, fmt.Errorf("unknown network prefix %#x", byte(addr.Network))
+	}
+	switch addr.Type {
+	case P2PK:
+		if len(addr.Content) != p2pkLength {
+			return nil, fmt.Errorf("P2PK address must contain %v bytes of public key", p2pkLength)
+		}
+	case P2SH:
+		if len(addr.Content) != p2shLength {
+			return nil, fmt.Errorf("P2SH address must contain %v bytes of script hash", p2shLength)
+		}
+	case P2S:
+	default:
+		return nil, fmt.Errorf("unknown address type %v", byte(addr.Type))
+	}
+	return addr, nil
+}
+
+// Hex encoded compressed public key of P2PK address, as node reports it in mining candidate
+func (a *Address) PubKeyHex() (string, error) {
+	if a.Type != P2PK {
+		return "", fmt.Errorf("%v address has no public key", a.Type)
+	}
+	return hex.EncodeToString(a.Content), nil
+}
+
+func IsValidAddress(s string) bool {
+	_, err := ParseAddress(s)
+	return err == nil
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+var base58Index [256]int
+
+func init() {
+	for i := range base58Index {
+		base58Index[i] = -1
+	}
+	for i := 0; i < len(base58Alphabet); i++ {
+		base58Index[base58Alphabet[i]] = i
+	}
+}
+
+func decodeBase58(s string) ([]byte, error) {
+	if len(s) == 0 {
+		return nil, ErrMalformedAddress
+	}
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	zeros := 0
+	for i := 0; i < len(s); i++ {
+		v := base58Index[s[i]]
+		if v < 0 {
+			return nil, ErrMalformedAddress
+		}
+		if v == 0 && i == zeros {
+			zeros++
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(v)))
+	}
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
@@ -0,0 +1,152 @@
+package ergo
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Addresses from mainnet and testnet explorers and Ergo reference tests
+var addressVectors = []struct {
+	address string
+	network NetworkType
+	typ     AddressType
+	content int
+}{
+	{"9fRWULXtir5FyBkdU4Z9Ux5RDKXDpbKaTyk7ihSXQg4TmqkW8vE", Mainnet, P2PK, p2pkLength},
+	{"9hY16vzHmmfyVBwKeFGHvb2bMFsG94A1u7To1QWtUokACyFVENQ", Mainnet, P2PK, p2pkLength},
+	{"3WvsT2Gm4EpsM9Pg18PdY6XyhNNMqXDsvJTbbf6ihLvAmSb7u5RN", Testnet, P2PK, p2pkLength},
+	{"3WwbzW6u8hKWBcL1W7kNVMr25s2UHfSBnYtwSHvrRQt7DdPuoXrt", Testnet, P2PK, p2pkLength},
+	{"8UApt8czfFVuTgQmMwtsRBZ4nfWquNiSwCWUjMg", Mainnet, P2SH, p2shLength},
+	{"4MQyML64GnzMxZgm", Mainnet, P2S, 7},
+	{"2Z4YBkDsDvQj8BX7xiySFewjitqp2ge9c99jfes2whbtKitZTxdBYqbrVZUvZvKv6aqn9by4kp3LE1c26LCyosFnVnm6b6U1JYvWpYmL2ZnixJbXLjWAWuBThV1D6dLpqZJYQHYDznJCk49g5TUiS4q8khpag2aNmHwREV7JSsypHdHLgJT7MGaw51aJfNubyzSKxZ4AJXFS27EfXwyCLzW1K6GVqwkJtCoPvrcLqmqwacAWJPkmh78nke9H4oT88XmSbRt2n9aWZjosiZCafZ4osUDxmZcc5QVEeTWn8drSraY3eFKe8Mu9MSCcVU", Mainnet, P2S, 228},
+}
+
+// Reference encoder, used to move known address content to another network prefix
+func encodeAddress(network NetworkType, typ AddressType, content []byte) string {
+	body := append([]byte{byte(network) | byte(typ)}, content...)
+	hash := blake2b.Sum256(body)
+	data := append(body, hash[:checksumLength]...)
+
+	n := new(big.Int).SetBytes(data)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append([]byte{base58Alphabet[mod.Int64()]}, out...)
+	}
+	for i := 0; i < len(data) && data[i] == 0; i++ {
+		out = append([]byte{base58Alphabet[0]}, out...)
+	}
+	return string(out)
+}
+
+func TestParseAddress(t *testing.T) {
+	for _, v := range addressVectors {
+		addr, err := ParseAddress(v.address)
+		if err != nil {
+			t.Errorf("%s: %v", v.address, err)
+			continue
+		}
+		if addr.Network != v.network || addr.Type != v.typ || len(addr.Content) != v.content {
+			t.Errorf("%s: got %v %v with %v bytes, want %v %v with %v bytes", v.address,
+				addr.Network, addr.Type, len(addr.Content), v.network, v.typ, v.content)
+		}
+		if encoded := encodeAddress(addr.Network, addr.Type, addr.Content); encoded != v.address {
+			t.Errorf("%s: reference encoder gives %s", v.address, encoded)
+		}
+	}
+}
+
+func TestParseTestnetScriptAddresses(t *testing.T) {
+	for _, v := range addressVectors {
+		if v.typ == P2PK {
+			continue
+		}
+		mainnet, err := ParseAddress(v.address)
+		if err != nil {
+			t.Fatalf("%s: %v", v.address, err)
+		}
+		s := encodeAddress(Testnet, v.typ, mainnet.Content)
+		addr, err := ParseAddress(s)
+		if err != nil {
+			t.Errorf("testnet %v %s: %v", v.typ, s, err)
+			continue
+		}
+		if addr.Network != Testnet || addr.Type != v.typ || !bytes.Equal(addr.Content, mainnet.Content) {
+			t.Errorf("testnet %v %s: got %v %v", v.typ, s, addr.Network, addr.Type)
+		}
+	}
+}
+
+func TestParseAddressChecksum(t *testing.T) {
+	for _, v := range addressVectors {
+		// Swap last character for another one of the alphabet
+		last := v.address[len(v.address)-1]
+		replacement := byte('2')
+		if last == replacement {
+			replacement = '3'
+		}
+		s := v.address[:len(v.address)-1] + string(replacement)
+		if _, err := ParseAddress(s); err != ErrChecksum {
+			t.Errorf("%s: got %v, want checksum error", s, err)
+		}
+	}
+}
+
+func TestParseAddressMalformed(t *testing.T) {
+	pk, _ := hex.DecodeString("02" + strings.Repeat("11", 32))
+	for _, s := range []string{
+		"",
+		"0x9fRWULXtir5FyBkdU4Z9Ux5RDKXDpbKaTyk7ihSXQg4TmqkW8vE",
+		"9fRWULXtir5FyBkdU4Z9Ux5RDKXDpbKaTyk7ihSXQg4TmqkW8vl",
+		"111",
+		// Valid checksum, but wrong content length and unknown prefixes
+		encodeAddress(Mainnet, P2PK, pk[:32]),
+		encodeAddress(Mainnet, P2SH, pk),
+		encodeAddress(Mainnet, AddressType(4), pk),
+		encodeAddress(NetworkType(0x20), P2PK, pk),
+	} {
+		if _, err := ParseAddress(s); err == nil {
+			t.Errorf("%q: malformed address accepted", s)
+		}
+	}
+	if _, err := ParseAddress(encodeAddress(Mainnet, P2PK, pk)); err != nil {
+		t.Errorf("well formed P2PK rejected: %v", err)
+	}
+}
+
+func TestValidateAddressNetwork(t *testing.T) {
+	for _, v := range addressVectors {
+		other := Testnet
+		if v.network == Testnet {
+			other = Mainnet
+		}
+		if err := v.network.ValidateAddress(v.address); err != nil {
+			t.Errorf("%s on %v: %v", v.address, v.network, err)
+		}
+		if other.IsValidAddress(v.address) {
+			t.Errorf("%s accepted on %v", v.address, other)
+		}
+	}
+}
+
+func TestPubKeyHex(t *testing.T) {
+	addr, err := ParseAddress("9fRWULXtir5FyBkdU4Z9Ux5RDKXDpbKaTyk7ihSXQg4TmqkW8vE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := addr.PubKeyHex()
+	if err != nil || len(pk) != 2*p2pkLength || (pk[:2] != "02" && pk[:2] != "03") {
+		t.Errorf("got pk %q, %v", pk, err)
+	}
+	script, _ := ParseAddress("8UApt8czfFVuTgQmMwtsRBZ4nfWquNiSwCWUjMg")
+	if _, err := script.PubKeyHex(); err == nil {
+		t.Error("P2SH address has no public key")
+	}
+}
@@ -0,0 +1,94 @@
+package ergo
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/big"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Autolykos v2 parameters
+const (
+	powK                  = 32
+	powNBase              = 1 << 26
+	powNIncreaseStart     = 600 * 1024
+	powNIncreasePeriod    = 50 * 1024
+	powNIncreaseHeightMax = 4198400
+)
+
+// Constant part of every table element, numbers 0..1023 as 8 byte big endian
+var powM = func() []byte {
+	m := make([]byte, 1024*8)
+	for i := 0; i < 1024; i++ {
+		binary.BigEndian.PutUint64(m[i*8:], uint64(i))
+	}
+	return m
+}()
+
+var ErrPowInput = errors.New("msg must be 32 bytes and nonce 8 bytes")
+
+// Table size N grows by 5% every period since increase start height
+func CalcN(height uint32) uint32 {
+	if height > powNIncreaseHeightMax {
+		height = powNIncreaseHeightMax
+	}
+	n := uint32(powNBase)
+	if height < powNIncreaseStart {
+		return n
+	}
+	iters := (height-powNIncreaseStart)/powNIncreasePeriod + 1
+	for i := uint32(0); i < iters; i++ {
+		n = n / 100 * 105
+	}
+	return n
+}
+
+// Autolykos v2 hit for header msg and miner's nonce, solution is valid when hit is below target
+func Hit(msg, nonce []byte, height uint32) (*big.Int, error) {
+	if len(msg) != 32 || len(nonce) != 8 {
+		return nil, ErrPowInput
+	}
+	n := CalcN(height)
+	h := make([]byte, 4)
+	binary.BigEndian.PutUint32(h, height)
+
+	seed := blake2b.Sum256(concat(msg, nonce))
+	i := make([]byte, 4)
+	binary.BigEndian.PutUint32(i, uint32(binary.BigEndian.Uint64(seed[24:])%uint64(n)))
+	e := blake2b.Sum256(concat(i, h, powM))
+
+	f := new(big.Int)
+	for _, idx := range genIndexes(concat(e[1:], msg, nonce), n) {
+		binary.BigEndian.PutUint32(i, idx)
+		element := blake2b.Sum256(concat(i, h, powM))
+		f.Add(f, new(big.Int).SetBytes(element[1:]))
+	}
+
+	// Sum of 32 elements of 31 bytes always fits 32 bytes
+	fb := f.Bytes()
+	hit := blake2b.Sum256(concat(make([]byte, 32-len(fb)), fb))
+	return new(big.Int).SetBytes(hit[:]), nil
+}
+
+func genIndexes(seed []byte, n uint32) []uint32 {
+	hash := blake2b.Sum256(seed)
+	extended := append(hash[:], hash[:3]...)
+	indexes := make([]uint32, powK)
+	for i := range indexes {
+		indexes[i] = binary.BigEndian.Uint32(extended[i:]) % n
+	}
+	return indexes
+}
+
+func concat(parts ...[]byte) []byte {
+	var size int
+	for _, p := range parts {
+		size += len(p)
+	}
+	b := make([]byte, 0, size)
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
@@ -0,0 +1,58 @@
+package ergo
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCalcN(t *testing.T) {
+	for _, v := range []struct {
+		height uint32
+		n      uint32
+	}{
+		{500000, 67108864},
+		{600000, 67108864},
+		{614400, 70464240},
+		{665600, 73987410},
+		{700000, 73987410},
+		{788400, 81571035},
+		{1051200, 104107290},
+		{4198400, 2143944600},
+		{41984000, 2143944600},
+	} {
+		if n := CalcN(v.height); n != v.n {
+			t.Errorf("N at height %v is %v, want %v", v.height, n, v.n)
+		}
+	}
+}
+
+func TestHit(t *testing.T) {
+	msg := bytes.Repeat([]byte{0x5a}, 32)
+	nonce := []byte{0, 0, 0, 0, 0, 0, 0x31, 0x05}
+	hit, err := Hit(msg, nonce, 614400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hit.Sign() <= 0 || hit.BitLen() > 256 {
+		t.Errorf("hit %v out of range", hit)
+	}
+	again, _ := Hit(msg, nonce, 614400)
+	if hit.Cmp(again) != 0 {
+		t.Error("hit is not deterministic")
+	}
+	other, _ := Hit(msg, []byte{0, 0, 0, 0, 0, 0, 0x31, 0x06}, 614400)
+	if hit.Cmp(other) == 0 {
+		t.Error("hit doesn't depend on nonce")
+	}
+	other, _ = Hit(msg, nonce, 614401)
+	if hit.Cmp(other) == 0 {
+		t.Error("hit doesn't depend on height")
+	}
+
+	if _, err := Hit(msg[:31], nonce, 614400); err != ErrPowInput {
+		t.Errorf("short msg: got %v", err)
+	}
+	if _, err := Hit(msg, nonce[:4], 614400); err != ErrPowInput {
+		t.Errorf("short nonce: got %v", err)
+	}
+}
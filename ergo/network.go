@@ -0,0 +1,88 @@
+package ergo
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// Coinbase outputs can't be spent until this many blocks on top
+const (
+	mainnetRewardDelay = 720
+	testnetRewardDelay = 720
+)
+
+// Lowest transaction fee node wallet accepts, in nanoERG
+const MinTxFee = 1000000
+
+// Emission schedule, amounts in nanoERG
+const (
+	nanoErg             = 1000000000
+	fixedRate           = 75 * nanoErg
+	foundersReward      = 75 * nanoErg / 10
+	oneEpochReduction   = 3 * nanoErg
+	fixedRatePeriod     = 525600
+	epochLength         = 64800
+	foundersRewardUntil = fixedRatePeriod + 2*epochLength
+
+	// EIP-27 moves part of the reward into re-emission contract
+	reemissionMainnetHeight = 777217
+	reemissionCharge        = 12 * nanoErg
+	reemissionBasicCharge   = 3 * nanoErg
+)
+
+// Empty name means mainnet for configs written before network setting
+func ParseNetwork(name string) (NetworkType, error) {
+	switch name {
+	case "", "mainnet":
+		return Mainnet, nil
+	case "testnet":
+		return Testnet, nil
+	}
+	return 0, fmt.Errorf("unknown network %q, must be mainnet or testnet", name)
+}
+
+// ValidateAddress parses address and checks it belongs to the network
+func (n NetworkType) ValidateAddress(s string) error {
+	addr, err := ParseAddress(s)
+	if err != nil {
+		return err
+	}
+	if addr.Network != n {
+		return fmt.Errorf("%s address on %s", addr.Network, n)
+	}
+	return nil
+}
+
+func (n NetworkType) IsValidAddress(s string) bool {
+	return n.ValidateAddress(s) == nil
+}
+
+// MinersReward is the block reward miner can spend once it's unlocked, in nanoERG
+func (n NetworkType) RewardDelay() int64 {
+	if n == Testnet {
+		return testnetRewardDelay
+	}
+	return mainnetRewardDelay
+}
+
+func (n NetworkType) MinersReward(height int64) *big.Int {
+	var reward int64
+	if height < foundersRewardUntil {
+		reward = fixedRate - foundersReward
+	} else {
+		epoch := 1 + (height-fixedRatePeriod)/epochLength
+		reward = fixedRate - oneEpochReduction*epoch
+		if reward < 0 {
+			reward = 0
+		}
+	}
+	if n == Mainnet && height >= reemissionMainnetHeight {
+		switch {
+		case reward >= reemissionCharge+reemissionBasicCharge:
+			reward -= reemissionCharge
+		case reward > reemissionBasicCharge:
+			reward = reemissionBasicCharge
+		}
+	}
+	return big.NewInt(reward)
+}
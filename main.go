@@ -3,43 +3,82 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"math/rand"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/NginProject/gorelic"
 
 	"github.com/maoxs2/ergoPool/api"
+	"github.com/maoxs2/ergoPool/ergo"
 	"github.com/maoxs2/ergoPool/payouts"
 	"github.com/maoxs2/ergoPool/proxy"
 	"github.com/maoxs2/ergoPool/storage"
 )
 
+// How long listeners wait for active requests on shutdown
+const shutdownTimeout = 30 * time.Second
+
 var cfg proxy.Config
+var network ergo.NetworkType
 var backend *storage.RedisClient
 
+var proxyServer *proxy.ProxyServer
+var apiServer *api.ApiServer
+var blockUnlocker *payouts.BlockUnlocker
+var payoutsProcessor *payouts.PayoutsProcessor
+
 func startProxy() {
-	s := proxy.NewProxy(&cfg, backend)
-	s.Start()
+	proxyServer = proxy.NewProxy(&cfg, network, backend)
+	go proxyServer.Start()
 }
 
 func startApi() {
-	s := api.NewApiServer(&cfg.Api, backend)
-	s.Start()
+	apiServer = api.NewApiServer(&cfg.Api, backend)
+	go apiServer.Start()
 }
 
 func startBlockUnlocker() {
-	u := payouts.NewBlockUnlocker(&cfg.BlockUnlocker, backend)
-	u.Start()
+	blockUnlocker = payouts.NewBlockUnlocker(&cfg.BlockUnlocker, network, backend)
+	blockUnlocker.Start()
 }
 
 func startPayoutsProcessor() {
-	u := payouts.NewPayoutsProcessor(&cfg.Payouts, backend)
-	u.Start()
+	payoutsProcessor = payouts.NewPayoutsProcessor(&cfg.Payouts, network, backend)
+	payoutsProcessor.Start()
+}
+
+// Proxy goes first so no new shares arrive, then API, then modules moving funds
+func shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Proxy flushes share journal into backend, so backend is closed last
+	if proxyServer != nil {
+		proxyServer.Shutdown(ctx)
+	}
+	if apiServer != nil {
+		if err := apiServer.Shutdown(ctx); err != nil {
+			log.Printf("API listener did not close in time: %v", err)
+		}
+	}
+	if blockUnlocker != nil {
+		blockUnlocker.Stop()
+	}
+	if payoutsProcessor != nil {
+		payoutsProcessor.Stop()
+	}
+	if err := backend.Close(); err != nil {
+		log.Printf("Failed to close backend connection: %v", err)
+	}
 }
 
 func startNewrelic() {
@@ -52,34 +91,66 @@ func startNewrelic() {
 	}
 }
 
-func readConfig(cfg *proxy.Config) {
-	configFileName := "config.json"
-	if len(os.Args) > 1 {
-		configFileName = os.Args[1]
+func readConfig(cfg *proxy.Config, configFileName string) {
+	if err := loadConfig(cfg, configFileName); err != nil {
+		log.Fatal(err)
 	}
+}
+
+func loadConfig(cfg *proxy.Config, configFileName string) error {
 	configFileName, _ = filepath.Abs(configFileName)
 	log.Printf("Loading config: %v", configFileName)
 
 	configFile, err := os.Open(configFileName)
 	if err != nil {
-		log.Fatal("File error: ", err.Error())
+		return fmt.Errorf("File error: %v", err)
 	}
 	defer configFile.Close()
 	jsonParser := json.NewDecoder(configFile)
-	if err := jsonParser.Decode(&cfg); err != nil {
-		log.Fatal("Config error: ", err.Error())
+	if err := jsonParser.Decode(cfg); err != nil {
+		return fmt.Errorf("Config error: %v", err)
 	}
+	return overrideFromEnv(cfg)
 }
 
 func main() {
-	readConfig(&cfg)
+	command, args := parseCommand(os.Args[1:])
+	configFileName := "config.json"
+	if len(args) > 0 {
+		configFileName = args[0]
+	}
+	readConfig(&cfg, configFileName)
+	activeConfig = cfg
 	rand.Seed(time.Now().UnixNano())
 
+	if command != nil {
+		backend = storage.NewRedisClient(&cfg.Redis, cfg.Coin)
+		os.Exit(command(args))
+	}
+
+	if problems := validateConfig(&cfg); len(problems) > 0 {
+		for _, problem := range problems {
+			log.Println(problem)
+		}
+		log.Fatalf("Config has %v problems, refusing to start", len(problems))
+	}
+
 	if cfg.Threads > 0 {
 		runtime.GOMAXPROCS(cfg.Threads)
 		log.Printf("Running with %v threads", cfg.Threads)
 	}
 
+	var err error
+	network, err = ergo.ParseNetwork(cfg.Network)
+	if err != nil {
+		log.Fatal("Config error: ", err)
+	}
+	log.Printf("Running on Ergo %s", network)
+
+	// Signals received while modules are starting are handled once all of them are up
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
 	startNewrelic()
 
 	backend = storage.NewRedisClient(&cfg.Redis, cfg.Coin)
@@ -91,17 +162,35 @@ func main() {
 	}
 
 	if cfg.Proxy.Enabled {
-		go startProxy()
+		startProxy()
 	}
 	if cfg.Api.Enabled {
-		go startApi()
+		startApi()
 	}
 	if cfg.BlockUnlocker.Enabled {
-		go startBlockUnlocker()
+		startBlockUnlocker()
 	}
 	if cfg.Payouts.Enabled {
-		go startPayoutsProcessor()
+		startPayoutsProcessor()
+	}
+
+	version := configVersion(&activeConfig)
+	publishConfigVersion(version)
+	log.Printf("Running config version %s", version)
+
+	sig := <-sigs
+	for sig == syscall.SIGHUP {
+		reloadConfig(configFileName)
+		sig = <-sigs
 	}
-	quit := make(chan bool)
-	<-quit
+	log.Printf("Received %v, shutting down", sig)
+	go func() {
+		for sig := range sigs {
+			if sig != syscall.SIGHUP {
+				log.Fatalf("Received %v again, exiting immediately", sig)
+			}
+		}
+	}()
+	shutdown()
+	log.Println("Shutdown complete")
 }
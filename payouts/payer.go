@@ -1,15 +1,17 @@
 package payouts
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math/big"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/ethereum/go-ethereum/common/hexutil"
-
+	"github.com/maoxs2/ergoPool/ergo"
 	"github.com/maoxs2/ergoPool/rpc"
 	"github.com/maoxs2/ergoPool/storage"
 	"github.com/maoxs2/ergoPool/util"
@@ -23,42 +25,67 @@ type PayoutsConfig struct {
 	Interval     string `json:"interval"`
 	Daemon       string `json:"daemon"`
 	Timeout      string `json:"timeout"`
+	ApiKey       string `json:"apiKey"`
 	Address      string `json:"address"`
-	Gas          string `json:"gas"`
-	GasPrice     string `json:"gasPrice"`
-	AutoGas      bool   `json:"autoGas"`
-	// In Shannon
+	// Transaction fee in nanoERG
+	Fee int64 `json:"fee"`
+	// In nanoERG
 	Threshold int64 `json:"threshold"`
 	BgSave    bool  `json:"bgsave"`
 }
 
-func (self PayoutsConfig) GasHex() string {
-	x := util.String2Big(self.Gas)
-	return hexutil.EncodeBig(x)
-}
-
-func (self PayoutsConfig) GasPriceHex() string {
-	x := util.String2Big(self.GasPrice)
-	return hexutil.EncodeBig(x)
-}
-
 type PayoutsProcessor struct {
 	config   *PayoutsConfig
+	network  ergo.NetworkType
 	backend  *storage.RedisClient
 	rpc      *rpc.RPCClient
 	halt     bool
 	lastFail error
+	quit     chan struct{}
+	wg       sync.WaitGroup
+
+	// Reloadable settings, read atomically
+	threshold int64
+	interval  int64
 }
 
-func NewPayoutsProcessor(cfg *PayoutsConfig, backend *storage.RedisClient) *PayoutsProcessor {
-	u := &PayoutsProcessor{config: cfg, backend: backend}
-	u.rpc = rpc.NewRPCClient("PayoutsProcessor", cfg.Daemon, cfg.Timeout)
+func NewPayoutsProcessor(cfg *PayoutsConfig, network ergo.NetworkType, backend *storage.RedisClient) *PayoutsProcessor {
+	if len(cfg.Address) != 0 {
+		if err := network.ValidateAddress(cfg.Address); err != nil {
+			log.Fatalf("Invalid pool address %s: %v", cfg.Address, err)
+		}
+	}
+	u := &PayoutsProcessor{config: cfg, network: network, backend: backend, quit: make(chan struct{})}
+	u.threshold = cfg.Threshold
+	u.rpc = rpc.NewRPCClient("PayoutsProcessor", cfg.Daemon, cfg.ApiKey, cfg.Timeout)
+	if err := u.rpc.CheckNetwork(network.String()); err != nil {
+		log.Fatalf("Refusing to start payouts: %v", err)
+	}
 	return u
 }
 
 func (u *PayoutsProcessor) Start() {
 	log.Println("Starting payouts")
 
+	// Payees are indexed by balance, so it must be in nanoERG already
+	n, err := u.backend.MigrateNanoErg()
+	if err != nil {
+		log.Println("Unable to start payouts, failed to migrate balances to nanoERG:", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Migrated %v balance keys from whole ERG to nanoERG", n)
+	}
+
+	n, err = u.backend.IndexPayees()
+	if err != nil {
+		log.Println("Unable to start payouts, failed to index payees:", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Indexed balances of %v payees", n)
+	}
+
 	if u.mustResolvePayout() {
 		log.Println("Running with env RESOLVE_PAYOUT=1, now trying to resolve locked payouts")
 		u.resolvePayouts()
@@ -67,6 +94,7 @@ func (u *PayoutsProcessor) Start() {
 	}
 
 	intv := util.MustParseDuration(u.config.Interval)
+	atomic.StoreInt64(&u.interval, int64(intv))
 	timer := time.NewTimer(intv)
 	log.Printf("Set payouts interval to %v", intv)
 
@@ -87,41 +115,100 @@ func (u *PayoutsProcessor) Start() {
 		return
 	}
 
-	// Immediately process payouts after start
-	u.process()
-	timer.Reset(intv)
-
+	u.wg.Add(1)
 	go func() {
+		defer u.wg.Done()
+
+		// Immediately process payouts after start
+		u.process()
+		timer.Reset(u.payoutInterval())
+
 		for {
 			select {
+			case <-u.quit:
+				timer.Stop()
+				return
 			case <-timer.C:
 				u.process()
-				timer.Reset(intv)
+				timer.Reset(u.payoutInterval())
 			}
 		}
 	}()
 }
 
+// Stop lets payment being broadcasted finish and skips the rest of payees
+func (u *PayoutsProcessor) Stop() {
+	log.Println("Stopping payouts")
+	close(u.quit)
+	u.wg.Wait()
+}
+
+// Reload applies payout threshold and interval, new interval is used after current wait
+func (u *PayoutsProcessor) Reload(cfg *PayoutsConfig) error {
+	intv, err := time.ParseDuration(cfg.Interval)
+	if err != nil {
+		return fmt.Errorf("invalid payouts interval: %v", err)
+	}
+	if intv <= 0 {
+		return fmt.Errorf("payouts interval must be positive")
+	}
+	atomic.StoreInt64(&u.threshold, cfg.Threshold)
+	atomic.StoreInt64(&u.interval, int64(intv))
+	log.Printf("Payouts reloaded: threshold %v, interval %v", cfg.Threshold, intv)
+	return nil
+}
+
+func (u *PayoutsProcessor) payoutInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&u.interval))
+}
+
+func (u *PayoutsProcessor) stopping() bool {
+	select {
+	case <-u.quit:
+		return true
+	default:
+		return false
+	}
+}
+
 func (u *PayoutsProcessor) process() {
 	if u.halt {
 		log.Println("Payments suspended due to last critical error:", u.lastFail)
 		return
 	}
+	if err := u.rpc.VerifyNetwork(); err != nil {
+		if rpc.IsNetworkMismatch(err) {
+			u.halt = true
+			u.lastFail = err
+		}
+		log.Printf("Unable to process payouts: %v", err)
+		return
+	}
 	mustPay := 0
 	minersPaid := 0
 	totalAmount := big.NewInt(0)
-	payees, err := u.backend.GetPayees()
+	payees, err := u.backend.GetPayees(atomic.LoadInt64(&u.threshold))
 	if err != nil {
 		log.Println("Error while retrieving payees from backend:", err)
 		return
 	}
 
-	for _, login := range payees {
-		amount, _ := u.backend.GetBalance(login)
+payees:
+	for _, payee := range payees {
+		login := payee.Login
+		// Index is only a hint, pay exactly what is on account
+		amount, err := u.backend.GetBalance(login)
+		if err != nil {
+			log.Printf("Failed to get balance of %s from backend: %v", login, err)
+			continue
+		}
 		bigAmount := big.NewInt(amount)
 
-		// Shannon^2 = Wei
-		//amountInWei := new(big.Int).Mul(amountInShannon, util.Shannon)
+		// Balance stays on account until miner fixes payout address
+		if err := u.network.ValidateAddress(login); err != nil {
+			log.Printf("Skipping payment to %s, invalid payout address: %v", login, err)
+			continue
+		}
 
 		if !u.reachedThreshold(bigAmount) {
 			continue
@@ -138,12 +225,13 @@ func (u *PayoutsProcessor) process() {
 		}
 
 		// Check if we have enough funds
-		poolBalance, err := u.rpc.GetBalance(u.config.Address)
+		wallet, err := u.rpc.GetWalletBalance(context.Background())
 		if err != nil {
 			u.halt = true
 			u.lastFail = err
 			break
 		}
+		poolBalance := big.NewInt(wallet.Balance - u.config.Fee)
 		if poolBalance.Cmp(bigAmount) < 0 {
 			err := fmt.Errorf("Not enough balance for payment, need %s ergo unit, pool has %s ergo unit",
 				bigAmount.String(), poolBalance.String())
@@ -152,6 +240,12 @@ func (u *PayoutsProcessor) process() {
 			break
 		}
 
+		// Once locked, payment must be broadcasted and logged, so stop only before that
+		if u.stopping() {
+			log.Println("Payouts are stopping, remaining payees are left for next run")
+			break
+		}
+
 		// Lock payments for current payout
 		err = u.backend.LockPayouts(login, amount)
 		if err != nil {
@@ -160,21 +254,20 @@ func (u *PayoutsProcessor) process() {
 			u.lastFail = err
 			break
 		}
-		log.Printf("Locked payment for %s, %v Shannon", login, amount)
+		log.Printf("Locked payment for %s, %v nanoERG", login, amount)
 
 		// Debit miner's balance and update stats
 		err = u.backend.UpdateBalance(login, amount)
 		if err != nil {
-			log.Printf("Failed to update balance for %s, %v Shannon: %v", login, amount, err)
+			log.Printf("Failed to update balance for %s, %v nanoERG: %v", login, amount, err)
 			u.halt = true
 			u.lastFail = err
 			break
 		}
 
-		value := hexutil.EncodeBig(bigAmount)
-		txHash, err := u.rpc.SendTransaction(u.config.Address, login, u.config.GasHex(), u.config.GasPriceHex(), value, u.config.AutoGas)
+		txHash, err := u.rpc.SendPayment(context.Background(), login, amount, u.config.Fee)
 		if err != nil {
-			log.Printf("Failed to send payment to %s, %v Shannon: %v. Check outgoing tx for %s in block explorer and docs/PAYOUTS.md",
+			log.Printf("Failed to send payment to %s, %v nanoERG: %v. Check outgoing tx for %s in block explorer and docs/PAYOUTS.md",
 				login, amount, err, login)
 			u.halt = true
 			u.lastFail = err
@@ -184,7 +277,7 @@ func (u *PayoutsProcessor) process() {
 		// Log transaction hash
 		err = u.backend.WritePayment(login, txHash, amount)
 		if err != nil {
-			log.Printf("Failed to log payment data for %s, %v Shannon, tx: %s: %v", login, amount, txHash, err)
+			log.Printf("Failed to log payment data for %s, %v nanoERG, tx: %s: %v", login, amount, txHash, err)
 			u.halt = true
 			u.lastFail = err
 			break
@@ -192,31 +285,35 @@ func (u *PayoutsProcessor) process() {
 
 		minersPaid++
 		totalAmount.Add(totalAmount, big.NewInt(amount))
-		log.Printf("Paid %v Shannon to %v, TxHash: %v", amount, login, txHash)
+		log.Printf("Paid %v nanoERG to %v, TxHash: %v", amount, login, txHash)
 
 		// Wait for TX confirmation before further payouts
 		for {
 			log.Printf("Waiting for tx confirmation: %v", txHash)
-			time.Sleep(txCheckInterval)
-			receipt, err := u.rpc.GetTxReceipt(txHash)
+			select {
+			case <-u.quit:
+				log.Printf("Payouts are stopping, not waiting for confirmation of %s", txHash)
+				break payees
+			case <-time.After(txCheckInterval):
+			}
+			tx, err := u.rpc.GetWalletTransaction(context.Background(), txHash)
+			if rpc.IsNotFound(err) {
+				continue
+			}
 			if err != nil {
-				log.Printf("Failed to get tx receipt for %v: %v", txHash, err)
+				log.Printf("Failed to get tx %v from wallet: %v", txHash, err)
 				continue
 			}
 			// Tx has been mined
-			if receipt != nil && receipt.Confirmed() {
-				if receipt.Successful() {
-					log.Printf("Payout tx successful for %s: %s", login, txHash)
-				} else {
-					log.Printf("Payout tx failed for %s: %s. Address contract throws on incoming tx.", login, txHash)
-				}
+			if tx.NumConfirmations > 0 {
+				log.Printf("Payout tx confirmed for %s: %s at height %v", login, txHash, tx.InclusionHeight)
 				break
 			}
 		}
 	}
 
 	if mustPay > 0 {
-		log.Printf("Paid total %v Shannon to %v of %v payees", totalAmount, minersPaid, mustPay)
+		log.Printf("Paid total %v nanoERG to %v of %v payees", totalAmount, minersPaid, mustPay)
 	} else {
 		log.Println("No payees that have reached payout threshold")
 	}
@@ -227,43 +324,45 @@ func (u *PayoutsProcessor) process() {
 	}
 }
 
-func (self PayoutsProcessor) isUnlockedAccount() bool {
-	//_, err := self.rpc.Sign(self.config.Address, "0x0")
-	//if err != nil {
-	//	log.Println("Unable to process payouts:", err)
-	//	return false
-	//}
-	//return true
-	return false
-
+func (self *PayoutsProcessor) isUnlockedAccount() bool {
+	status, err := self.rpc.GetWalletStatus(context.Background())
+	if err != nil {
+		log.Println("Unable to process payouts, failed to get wallet status from node:", err)
+		return false
+	}
+	if !status.IsUnlocked {
+		log.Println("Unable to process payouts, node wallet is locked")
+		return false
+	}
+	return true
 }
 
-func (self PayoutsProcessor) checkPeers() bool {
-	n, err := self.rpc.GetPeerCount()
+func (self *PayoutsProcessor) checkPeers() bool {
+	info, err := self.rpc.GetInfo(context.Background())
 	if err != nil {
 		log.Println("Unable to start payouts, failed to retrieve number of peers from node:", err)
 		return false
 	}
-	if n < self.config.RequirePeers {
+	if info.PeersCount < self.config.RequirePeers {
 		log.Println("Unable to start payouts, number of peers on a node is less than required", self.config.RequirePeers)
 		return false
 	}
 	return true
 }
 
-func (self PayoutsProcessor) reachedThreshold(amount *big.Int) bool {
-	return big.NewInt(self.config.Threshold).Cmp(amount) < 0
+func (self *PayoutsProcessor) reachedThreshold(amount *big.Int) bool {
+	return big.NewInt(atomic.LoadInt64(&self.threshold)).Cmp(amount) < 0
 }
 
 func formatPendingPayments(list []*storage.PendingPayment) string {
 	var s string
 	for _, v := range list {
-		s += fmt.Sprintf("\tAddress: %s, Amount: %v Shannon, %v\n", v.Address, v.Amount, time.Unix(v.Timestamp, 0))
+		s += fmt.Sprintf("\tAddress: %s, Amount: %v nanoERG, %v\n", v.Address, v.Amount, time.Unix(v.Timestamp, 0))
 	}
 	return s
 }
 
-func (self PayoutsProcessor) bgSave() {
+func (self *PayoutsProcessor) bgSave() {
 	result, err := self.backend.BgSave()
 	if err != nil {
 		log.Println("Failed to perform BGSAVE on backend:", err)
@@ -272,7 +371,7 @@ func (self PayoutsProcessor) bgSave() {
 	log.Println("Saving backend state to disk:", result)
 }
 
-func (self PayoutsProcessor) resolvePayouts() {
+func (self *PayoutsProcessor) resolvePayouts() {
 	payments := self.backend.GetPendingPayments()
 
 	if len(payments) > 0 {
@@ -281,10 +380,10 @@ func (self PayoutsProcessor) resolvePayouts() {
 		for _, v := range payments {
 			err := self.backend.RollbackBalance(v.Address, v.Amount)
 			if err != nil {
-				log.Printf("Failed to credit %v Shannon back to %s, error is: %v", v.Amount, v.Address, err)
+				log.Printf("Failed to credit %v nanoERG back to %s, error is: %v", v.Amount, v.Address, err)
 				return
 			}
-			log.Printf("Credited %v Shannon back to %s", v.Amount, v.Address)
+			log.Printf("Credited %v nanoERG back to %s", v.Amount, v.Address)
 		}
 		err := self.backend.UnlockPayouts()
 		if err != nil {
@@ -301,7 +400,7 @@ func (self PayoutsProcessor) resolvePayouts() {
 	log.Println("Payouts unlocked")
 }
 
-func (self PayoutsProcessor) mustResolvePayout() bool {
+func (self *PayoutsProcessor) mustResolvePayout() bool {
 	v, _ := strconv.ParseBool(os.Getenv("RESOLVE_PAYOUT"))
 	return v
 }
@@ -1,15 +1,16 @@
 package payouts
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math/big"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/ethereum/go-ethereum/common/math"
-
+	"github.com/maoxs2/ergoPool/ergo"
 	"github.com/maoxs2/ergoPool/rpc"
 	"github.com/maoxs2/ergoPool/storage"
 	"github.com/maoxs2/ergoPool/util"
@@ -19,6 +20,7 @@ type UnlockerConfig struct {
 	Enabled        bool    `json:"enabled"`
 	PoolFee        float64 `json:"poolFee"`
 	PoolFeeAddress string  `json:"poolFeeAddress"`
+	SoloFee        float64 `json:"soloFee"`
 	Donate         bool    `json:"donate"`
 	Depth          int64   `json:"depth"`
 	ImmatureDepth  int64   `json:"immatureDepth"`
@@ -26,56 +28,84 @@ type UnlockerConfig struct {
 	Interval       string  `json:"interval"`
 	Daemon         string  `json:"daemon"`
 	Timeout        string  `json:"timeout"`
+	// Leave round shares of matured blocks for API retention policy
+	KeepRoundShares bool `json:"keepRoundShares"`
 }
 
 const minDepth = 16
-const byzantiumHardForkHeight = 4370000
 
-// 67500000000 = 67.5
-// 1000000000 = 1
-var homesteadReward = math.MustParseBig256("75000000000")
-var byzantiumReward = math.MustParseBig256("75000000000")
+// Lowest immature depth unlocker accepts
+const MinImmatureDepth = minDepth
 
 // Donate 10% from pool fees to developers
 const donationAccount = "9fRWULXtir5FyBkdU4Z9Ux5RDKXDpbKaTyk7ihSXQg4TmqkW8vE"
 
 type BlockUnlocker struct {
 	config   *UnlockerConfig
+	network  ergo.NetworkType
 	backend  *storage.RedisClient
 	rpc      *rpc.RPCClient
 	halt     bool
 	lastFail error
+	quit     chan struct{}
+	wg       sync.WaitGroup
 }
 
-func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient) *BlockUnlocker {
-	if len(cfg.PoolFeeAddress) != 0 && !util.IsValidHexAddress(cfg.PoolFeeAddress) {
-		log.Fatalln("Invalid poolFeeAddress", cfg.PoolFeeAddress)
+func NewBlockUnlocker(cfg *UnlockerConfig, network ergo.NetworkType, backend *storage.RedisClient) *BlockUnlocker {
+	if len(cfg.PoolFeeAddress) != 0 {
+		if err := network.ValidateAddress(cfg.PoolFeeAddress); err != nil {
+			log.Fatalf("Invalid poolFeeAddress %s: %v", cfg.PoolFeeAddress, err)
+		}
+	}
+	if cfg.Donate && !network.IsValidAddress(donationAccount) {
+		log.Printf("Donation account is on mainnet, disabling donation on %s", network)
+		cfg.Donate = false
 	}
-	if cfg.Depth < minDepth*2 {
-		log.Fatalf("Block maturity depth can't be < %v, your depth is %v", minDepth*2, cfg.Depth)
+	// Rewards can't be paid out before coinbase is unlocked
+	if cfg.Depth < network.RewardDelay() {
+		log.Fatalf("Block maturity depth can't be < %v on %s, your depth is %v", network.RewardDelay(), network, cfg.Depth)
 	}
 	if cfg.ImmatureDepth < minDepth {
 		log.Fatalf("Immature depth can't be < %v, your depth is %v", minDepth, cfg.ImmatureDepth)
 	}
-	u := &BlockUnlocker{config: cfg, backend: backend}
-	u.rpc = rpc.NewRPCClient("BlockUnlocker", cfg.Daemon, cfg.Timeout)
+	backend.SetKeepRoundShares(cfg.KeepRoundShares)
+	u := &BlockUnlocker{config: cfg, network: network, backend: backend, quit: make(chan struct{})}
+	u.rpc = rpc.NewRPCClient("BlockUnlocker", cfg.Daemon, "", cfg.Timeout)
+	if err := u.rpc.CheckNetwork(network.String()); err != nil {
+		log.Fatalf("Refusing to start block unlocker: %v", err)
+	}
 	return u
 }
 
 func (u *BlockUnlocker) Start() {
 	log.Println("Starting block unlocker")
+
+	n, err := u.backend.MigrateNanoErg()
+	if err != nil {
+		log.Println("Unable to start block unlocker, failed to migrate balances to nanoERG:", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Migrated %v balance keys from whole ERG to nanoERG", n)
+	}
 	intv := util.MustParseDuration(u.config.Interval)
 	timer := time.NewTimer(intv)
 	log.Printf("Set block unlock interval to %v", intv)
 
-	// Immediately unlock after start
-	u.unlockPendingBlocks()
-	u.unlockAndCreditMiners()
-	timer.Reset(intv)
-
+	u.wg.Add(1)
 	go func() {
+		defer u.wg.Done()
+
+		// Immediately unlock after start
+		u.unlockPendingBlocks()
+		u.unlockAndCreditMiners()
+		timer.Reset(intv)
+
 		for {
 			select {
+			case <-u.quit:
+				timer.Stop()
+				return
 			case <-timer.C:
 				u.unlockPendingBlocks()
 				u.unlockAndCreditMiners()
@@ -85,6 +115,13 @@ func (u *BlockUnlocker) Start() {
 	}()
 }
 
+// Stop waits for running unlock pass to complete
+func (u *BlockUnlocker) Stop() {
+	log.Println("Stopping block unlocker")
+	close(u.quit)
+	u.wg.Wait()
+}
+
 type UnlockResult struct {
 	maturedBlocks  []*storage.BlockData
 	orphanedBlocks []*storage.BlockData
@@ -102,8 +139,6 @@ type UnlockResult struct {
 func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*UnlockResult, error) {
 	result := &UnlockResult{}
 
-	// Data row is: "height:nonce:powHash:mixDigest:timestamp:diff:totalShares"
-	// Data row is: "height:PK:W:N:D:timestamp:diff:totalShares"
 	for _, candidate := range candidates {
 		orphan := true
 
@@ -117,7 +152,7 @@ func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*Unlo
 				continue
 			}
 
-			block, err := u.rpc.GetBlockByHeight(height)
+			block, err := u.rpc.GetBlockByHeight(context.Background(), height)
 			if err != nil {
 				log.Printf("Error while retrieving block %v from node: %v", height, err)
 				return nil, err
@@ -159,27 +194,19 @@ func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*Unlo
 
 func matchCandidate(block *rpc.BlockHeader, candidate *storage.BlockData) bool {
 	// Just compare hash if block is unlocked as immature
-	if len(candidate.Hash) > 0 && strings.EqualFold(candidate.Hash, block.Hash) {
+	if len(candidate.Hash) > 0 && strings.EqualFold(candidate.Hash, block.Id) {
 		return true
 	}
-	// Geth-style candidate matching
-	if len(block.PoWSol.PublicKey) > 0 {
-		return strings.EqualFold(block.PoWSol.PublicKey, candidate.PK)
+	// Every pool block has the same miner pk, so nonce tells ours apart
+	if len(block.PoWSol.N) > 0 && len(candidate.N) > 0 {
+		return strings.EqualFold(block.PoWSol.PublicKey, candidate.PK) && strings.EqualFold(block.PoWSol.N, candidate.N)
 	}
-	// Parity's EIP: https://github.com/ethereum/EIPs/issues/95
-	//if len(block.SealFields) == 2 {
-	//	return strings.EqualFold(candidate.PK, block.SealFields[1])
-	//}
 	return false
 }
 
 func (u *BlockUnlocker) handleBlock(block *rpc.BlockHeader, candidate *storage.BlockData) error {
-	correctHeight, err := strconv.ParseInt(strings.Replace(block.Number, "0x", "", -1), 16, 64)
-	if err != nil {
-		return err
-	}
-	candidate.Height = correctHeight
-	reward := getConstReward(candidate.Height)
+	candidate.Height = block.Height
+	reward := u.network.MinersReward(candidate.Height)
 
 	// Add TX fees
 	//extraTxReward, err := u.getExtraRewardForTx(block)
@@ -193,7 +220,7 @@ func (u *BlockUnlocker) handleBlock(block *rpc.BlockHeader, candidate *storage.B
 	//}
 
 	candidate.Orphan = false
-	candidate.Hash = block.Hash
+	candidate.Hash = block.Id
 	candidate.Reward = reward
 	return nil
 }
@@ -203,21 +230,23 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 		log.Println("Unlocking suspended due to last critical error:", u.lastFail)
 		return
 	}
-
-	current, err := u.rpc.GetPendingBlock()
-	if err != nil {
-		u.halt = true
-		u.lastFail = err
-		log.Printf("Unable to get current blockchain height from node: %v", err)
+	if err := u.rpc.VerifyNetwork(); err != nil {
+		if rpc.IsNetworkMismatch(err) {
+			u.halt = true
+			u.lastFail = err
+		}
+		log.Printf("Unable to unlock blocks: %v", err)
 		return
 	}
-	currentHeight, err := strconv.ParseInt(strings.Replace(current.Number, "0x", "", -1), 16, 64)
+
+	info, err := u.rpc.GetInfo(context.Background())
 	if err != nil {
 		u.halt = true
 		u.lastFail = err
-		log.Printf("Can't parse pending block number: %v", err)
+		log.Printf("Unable to get current blockchain height from node: %v", err)
 		return
 	}
+	currentHeight := info.FullHeight
 
 	candidates, err := u.backend.GetCandidates(currentHeight - u.config.ImmatureDepth)
 	if err != nil {
@@ -283,7 +312,7 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 		)
 		entries := []string{logEntry}
 		for login, reward := range roundRewards {
-			entries = append(entries, fmt.Sprintf("\tREWARD %v: %v: %v Shannon", block.RoundKey(), login, reward))
+			entries = append(entries, fmt.Sprintf("\tREWARD %v: %v: %v nanoERG", block.RoundKey(), login, reward))
 		}
 		log.Println(strings.Join(entries, "\n"))
 	}
@@ -302,20 +331,14 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 		return
 	}
 
-	current, err := u.rpc.GetPendingBlock()
+	info, err := u.rpc.GetInfo(context.Background())
 	if err != nil {
 		u.halt = true
 		u.lastFail = err
 		log.Printf("Unable to get current blockchain height from node: %v", err)
 		return
 	}
-	currentHeight, err := strconv.ParseInt(strings.Replace(current.Number, "0x", "", -1), 16, 64)
-	if err != nil {
-		u.halt = true
-		u.lastFail = err
-		log.Printf("Can't parse pending block number: %v", err)
-		return
-	}
+	currentHeight := info.FullHeight
 
 	immature, err := u.backend.GetImmatureBlocks(currentHeight - u.config.Depth)
 	if err != nil {
@@ -382,7 +405,7 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 		)
 		entries := []string{logEntry}
 		for login, reward := range roundRewards {
-			entries = append(entries, fmt.Sprintf("\tREWARD %v: %v: %v Shannon", block.RoundKey(), login, reward))
+			entries = append(entries, fmt.Sprintf("\tREWARD %v: %v: %v nanoERG", block.RoundKey(), login, reward))
 		}
 		log.Println(strings.Join(entries, "\n"))
 	}
@@ -397,9 +420,15 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 
 func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *big.Rat, *big.Rat, map[string]int64, error) {
 	revenue := new(big.Rat).SetInt(block.Reward)
-	minersProfit, poolProfit := chargeFee(revenue, 2*u.config.PoolFee)
+	var minersProfit, poolProfit *big.Rat
+	// Solo round holds only finder's shares, so finder gets everything but solo fee
+	if block.Solo {
+		minersProfit, poolProfit = chargeFee(revenue, u.config.SoloFee)
+	} else {
+		minersProfit, poolProfit = chargeFee(revenue, 2*u.config.PoolFee)
+	}
 
-	shares, err := u.backend.GetRoundShares(block.RoundHeight, block.PK)
+	shares, err := u.backend.GetRoundShares(block.RoundHeight, block.RoundId())
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
@@ -412,19 +441,22 @@ func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *b
 		revenue.Add(revenue, extraReward)
 	}
 
-	if u.config.Donate {
+	poolProfit = u.creditPoolProfit(rewards, poolProfit, block.Solo)
+	return revenue, minersProfit, poolProfit, rewards, nil
+}
+
+// Donation is a share of pool fee, solo blocks are charged solo fee only
+func (u *BlockUnlocker) creditPoolProfit(rewards map[string]int64, poolProfit *big.Rat, solo bool) *big.Rat {
+	if u.config.Donate && !solo {
 		var donation = new(big.Rat)
 		poolProfit, donation = chargeFee(poolProfit, u.config.PoolFee)
-		login := strings.ToLower(donationAccount)
-		rewards[login] += weiToShannonInt64(donation)
+		rewards[donationAccount] += nanoErgInt64(donation)
 	}
 
 	if len(u.config.PoolFeeAddress) != 0 {
-		address := strings.ToLower(u.config.PoolFeeAddress)
-		rewards[address] += weiToShannonInt64(poolProfit)
+		rewards[u.config.PoolFeeAddress] += nanoErgInt64(poolProfit)
 	}
-
-	return revenue, minersProfit, poolProfit, rewards, nil
+	return poolProfit
 }
 
 func calculateRewardsForShares(shares map[string]int64, total int64, reward *big.Rat) map[string]int64 {
@@ -433,7 +465,7 @@ func calculateRewardsForShares(shares map[string]int64, total int64, reward *big
 	for login, n := range shares {
 		percent := big.NewRat(n, total)
 		workerReward := new(big.Rat).Mul(reward, percent)
-		rewards[login] += weiToShannonInt64(workerReward)
+		rewards[login] += nanoErgInt64(workerReward)
 	}
 	return rewards
 }
@@ -445,16 +477,8 @@ func chargeFee(value *big.Rat, fee float64) (*big.Rat, *big.Rat) {
 	return new(big.Rat).Sub(value, feeValue), feeValue
 }
 
-func weiToShannonInt64(wei *big.Rat) int64 {
-	shannon := new(big.Rat).SetInt(util.Shannon)
-	inShannon := new(big.Rat).Quo(wei, shannon)
-	value, _ := strconv.ParseInt(inShannon.FloatString(0), 10, 64)
-	return value
-}
-
-func getConstReward(height int64) *big.Int {
-	if height >= byzantiumHardForkHeight {
-		return new(big.Int).Set(byzantiumReward)
-	}
-	return new(big.Int).Set(homesteadReward)
+// Rewards are calculated and credited in nanoERG, fractions are rounded
+func nanoErgInt64(value *big.Rat) int64 {
+	result, _ := strconv.ParseInt(value.FloatString(0), 10, 64)
+	return result
 }
@@ -0,0 +1,55 @@
+package payouts
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/maoxs2/ergoPool/ergo"
+)
+
+func TestCalculateRewardsForShares(t *testing.T) {
+	// 67.5 ERG, miners reward at fixed rate period
+	reward := ergo.Mainnet.MinersReward(100000)
+	if reward.Int64() != 67500000000 {
+		t.Fatalf("unexpected block reward %v", reward)
+	}
+	revenue := new(big.Rat).SetInt(reward)
+	minersProfit, poolProfit := chargeFee(revenue, 1)
+	if nanoErgInt64(poolProfit) != 675000000 {
+		t.Errorf("pool profit %v nanoERG, want 675000000", poolProfit.FloatString(0))
+	}
+
+	shares := map[string]int64{"miner1": 1, "miner2": 3}
+	rewards := calculateRewardsForShares(shares, 4, minersProfit)
+	if rewards["miner1"] != 16706250000 {
+		t.Errorf("miner1 credited %v nanoERG, want 16706250000", rewards["miner1"])
+	}
+	if rewards["miner2"] != 50118750000 {
+		t.Errorf("miner2 credited %v nanoERG, want 50118750000", rewards["miner2"])
+	}
+	if total := rewards["miner1"] + rewards["miner2"] + nanoErgInt64(poolProfit); total != reward.Int64() {
+		t.Errorf("credited %v nanoERG in total, block reward is %v", total, reward)
+	}
+}
+
+func TestSoloBlockIsNotDonated(t *testing.T) {
+	u := &BlockUnlocker{config: &UnlockerConfig{PoolFee: 1, SoloFee: 1, Donate: true, PoolFeeAddress: "fee"}}
+
+	rewards := make(map[string]int64)
+	poolProfit := u.creditPoolProfit(rewards, big.NewRat(675000000, 1), true)
+	if _, ok := rewards[donationAccount]; ok {
+		t.Error("donation taken from solo block")
+	}
+	if rewards["fee"] != 675000000 || nanoErgInt64(poolProfit) != 675000000 {
+		t.Errorf("solo fee credited %v, want 675000000", rewards["fee"])
+	}
+
+	rewards = make(map[string]int64)
+	poolProfit = u.creditPoolProfit(rewards, big.NewRat(1350000000, 1), false)
+	if rewards[donationAccount] != 13500000 {
+		t.Errorf("donation %v, want 13500000", rewards[donationAccount])
+	}
+	if rewards["fee"] != 1336500000 || nanoErgInt64(poolProfit) != 1336500000 {
+		t.Errorf("pool fee credited %v, want 1336500000", rewards["fee"])
+	}
+}
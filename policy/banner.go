@@ -0,0 +1,204 @@
+package policy
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maoxs2/ergoPool/util"
+)
+
+// Banner enforces bans outside of policy stats, e.g. in firewall
+type Banner interface {
+	Ban(ip string, timeout time.Duration) error
+	Unban(ip string) error
+}
+
+// Firewall backends check on start that their set accepts IPv6 prefixes like 2001:db8::/64
+type prefixBanner interface {
+	CheckPrefixes() error
+}
+
+// Checks that configured ban backend can be set up
+func ValidateBanning(cfg *Banning) error {
+	_, err := newBanner(cfg)
+	return err
+}
+
+func newBanner(cfg *Banning) (Banner, error) {
+	backend := cfg.Backend
+	if len(backend) == 0 {
+		// Keep behaviour of configs without backend setting
+		if len(cfg.IPSet) > 0 {
+			backend = "ipset"
+		} else {
+			backend = "log"
+		}
+	}
+
+	switch backend {
+	case "ipset":
+		if len(cfg.IPSet) == 0 {
+			return nil, fmt.Errorf("ipset name is required for ipset banning")
+		}
+		return &ipsetBanner{set: cfg.IPSet}, nil
+	case "nftables":
+		if len(cfg.NftTable) == 0 || len(cfg.NftSet) == 0 {
+			return nil, fmt.Errorf("nftTable and nftSet are required for nftables banning")
+		}
+		return &nftBanner{table: cfg.NftTable, set: cfg.NftSet, set6: cfg.NftSet6}, nil
+	case "denylist":
+		return &denyList{entries: make(map[string]int64)}, nil
+	case "log":
+		return logBanner{}, nil
+	case "none":
+		return noopBanner{}, nil
+	}
+	return nil, fmt.Errorf("unknown banning backend %s", backend)
+}
+
+type ipsetBanner struct {
+	set string
+}
+
+func (b *ipsetBanner) Ban(ip string, timeout time.Duration) error {
+	log.Printf("Banned %v with timeout %v on ipset %s", ip, timeout, b.set)
+	return run("sudo ipset add %s %s timeout %v -!", b.set, ip, int64(timeout/time.Second))
+}
+
+func (b *ipsetBanner) Unban(ip string) error {
+	log.Printf("Unbanned %v on ipset %s", ip, b.set)
+	return run("sudo ipset del %s %s -!", b.set, ip)
+}
+
+func (b *ipsetBanner) CheckPrefixes() error {
+	out, err := output("sudo ipset list %s -t", b.set)
+	if err != nil {
+		return err
+	}
+	if kind := ipsetType(out); !strings.HasPrefix(kind, "hash:net") {
+		return fmt.Errorf("ipset %s is of type %q, IPv6 prefix bans need hash:net set", b.set, kind)
+	}
+	return nil
+}
+
+// Type from header of "ipset list -t"
+func ipsetType(list string) string {
+	for _, line := range strings.Split(list, "\n") {
+		if strings.HasPrefix(line, "Type:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "Type:"))
+		}
+	}
+	return ""
+}
+
+// Set must be declared with timeout flag, IPv6 addresses go to separate set if configured
+type nftBanner struct {
+	table string
+	set   string
+	set6  string
+}
+
+func (b *nftBanner) setFor(ip string) string {
+	if strings.Contains(ip, ":") && len(b.set6) > 0 {
+		return b.set6
+	}
+	return b.set
+}
+
+func (b *nftBanner) Ban(ip string, timeout time.Duration) error {
+	set := b.setFor(ip)
+	log.Printf("Banned %v with timeout %v on nftables set %s %s", ip, timeout, b.table, set)
+	return run("sudo nft add element %s %s { %s timeout %vs }", b.table, set, ip, int64(timeout/time.Second))
+}
+
+func (b *nftBanner) Unban(ip string) error {
+	set := b.setFor(ip)
+	log.Printf("Unbanned %v on nftables set %s %s", ip, b.table, set)
+	return run("sudo nft delete element %s %s { %s }", b.table, set, ip)
+}
+
+// Set receiving IPv6 addresses must be an interval set
+func (b *nftBanner) CheckPrefixes() error {
+	set := b.setFor("::")
+	out, err := output("sudo nft list set %s %s", b.table, set)
+	if err != nil {
+		return err
+	}
+	if !nftIntervalSet(out) {
+		return fmt.Errorf("nftables set %s %s has no interval flag, IPv6 prefix bans need flags interval", b.table, set)
+	}
+	return nil
+}
+
+func nftIntervalSet(list string) bool {
+	for _, line := range strings.Split(list, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "flags ") && strings.Contains(line, "interval") {
+			return true
+		}
+	}
+	return false
+}
+
+func run(format string, args ...interface{}) error {
+	_, err := output(format, args...)
+	return err
+}
+
+func output(format string, args ...interface{}) (string, error) {
+	fields := strings.Fields(fmt.Sprintf(format, args...))
+	out, err := exec.Command(fields[0], fields[1:]...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// In-process deny list, checked by PolicyServer.IsBanned for every request
+type denyList struct {
+	sync.RWMutex
+	entries map[string]int64
+}
+
+func (d *denyList) Ban(ip string, timeout time.Duration) error {
+	d.Lock()
+	d.entries[ip] = util.MakeTimestamp() + int64(timeout/time.Millisecond)
+	d.Unlock()
+	log.Printf("Banned %v with timeout %v on deny list", ip, timeout)
+	return nil
+}
+
+func (d *denyList) Unban(ip string) error {
+	d.Lock()
+	delete(d.entries, ip)
+	d.Unlock()
+	log.Printf("Unbanned %v on deny list", ip)
+	return nil
+}
+
+func (d *denyList) Banned(ip string) bool {
+	d.RLock()
+	defer d.RUnlock()
+	return d.entries[ip] > util.MakeTimestamp()
+}
+
+type logBanner struct{}
+
+func (logBanner) Ban(ip string, timeout time.Duration) error {
+	log.Printf("Banned peer %v with timeout %v", ip, timeout)
+	return nil
+}
+
+func (logBanner) Unban(ip string) error {
+	log.Printf("Unbanned peer %v", ip)
+	return nil
+}
+
+type noopBanner struct{}
+
+func (noopBanner) Ban(ip string, timeout time.Duration) error { return nil }
+func (noopBanner) Unban(ip string) error                      { return nil }
@@ -0,0 +1,26 @@
+package policy
+
+import "testing"
+
+func TestPrefixCapableSets(t *testing.T) {
+	ipsets := map[string]string{
+		"Name: blacklist\nType: hash:ip\nRevision: 4\nHeader: family inet hashsize 1024 maxelem 65536 timeout 1800\n":   "hash:ip",
+		"Name: blacklist\nType: hash:net\nRevision: 6\nHeader: family inet6 hashsize 1024 maxelem 65536 timeout 1800\n": "hash:net",
+	}
+	for list, want := range ipsets {
+		if kind := ipsetType(list); kind != want {
+			t.Errorf("ipset type %q, want %q", kind, want)
+		}
+	}
+
+	sets := map[string]bool{
+		"table inet filter {\n\tset blacklist6 {\n\t\ttype ipv6_addr\n\t\tflags timeout\n\t}\n}\n":          false,
+		"table inet filter {\n\tset blacklist6 {\n\t\ttype ipv6_addr\n\t\tflags interval,timeout\n\t}\n}\n": true,
+		"table inet filter {\n\tset blacklist6 {\n\t\ttype ipv6_addr\n\t\tflags timeout,interval\n\t}\n}\n": true,
+	}
+	for list, want := range sets {
+		if got := nftIntervalSet(list); got != want {
+			t.Errorf("interval set %v, want %v for %q", got, want, list)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package policy
+
+import (
+	"log"
+	"net"
+	"strings"
+)
+
+// Matches addresses against exact IPs and CIDR ranges
+type ipMatcher struct {
+	exact map[string]struct{}
+	nets  []*net.IPNet
+}
+
+func newIPMatcher(entries []string) *ipMatcher {
+	m := &ipMatcher{exact: make(map[string]struct{})}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			_, ipnet, err := net.ParseCIDR(entry)
+			if err != nil {
+				log.Printf("Ignoring malformed CIDR %q: %v", entry, err)
+				continue
+			}
+			m.nets = append(m.nets, ipnet)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			log.Printf("Ignoring malformed IP %q", entry)
+			continue
+		}
+		m.exact[ip.String()] = struct{}{}
+	}
+	return m
+}
+
+// Accepts plain address or prefix key made by PolicyServer.key
+func (m *ipMatcher) Contains(addr string) bool {
+	if m == nil {
+		return false
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		var err error
+		ip, _, err = net.ParseCIDR(addr)
+		if err != nil {
+			return false
+		}
+	}
+	if _, ok := m.exact[ip.String()]; ok {
+		return true
+	}
+	for _, ipnet := range m.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ipMatcher) Len() int {
+	if m == nil {
+		return 0
+	}
+	return len(m.exact) + len(m.nets)
+}
+
+// IPv6 clients are accounted per prefix, because they can rotate addresses within it
+func prefixKey(addr string, bits int) string {
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() != nil || bits <= 0 || bits >= 128 {
+		return addr
+	}
+	mask := net.CIDRMask(bits, 128)
+	ipnet := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	return ipnet.String()
+}
@@ -3,8 +3,7 @@ package policy
 import (
 	"fmt"
 	"log"
-	"os/exec"
-	"strings"
+	"math"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,6 +14,7 @@ import (
 
 type Config struct {
 	Workers         int     `json:"workers"`
+	IPv6Prefix      int     `json:"ipv6Prefix"`
 	Banning         Banning `json:"banning"`
 	Limits          Limits  `json:"limits"`
 	ResetInterval   string  `json:"resetInterval"`
@@ -30,11 +30,21 @@ type Limits struct {
 
 type Banning struct {
 	Enabled        bool    `json:"enabled"`
+	Backend        string  `json:"backend"`
 	IPSet          string  `json:"ipset"`
+	NftTable       string  `json:"nftTable"`
+	NftSet         string  `json:"nftSet"`
+	NftSet6        string  `json:"nftSet6"`
 	Timeout        int64   `json:"timeout"`
 	InvalidPercent float32 `json:"invalidPercent"`
 	CheckThreshold int32   `json:"checkThreshold"`
 	MalformedLimit int32   `json:"malformedLimit"`
+	// Every repeated ban within offense window multiplies timeout, up to max timeout
+	EscalationFactor float64 `json:"escalationFactor"`
+	MaxTimeout       int64   `json:"maxTimeout"`
+	OffenseWindow    string  `json:"offenseWindow"`
+	// Publish bans through Redis and apply bans of other instances
+	Shared bool `json:"shared"`
 }
 
 type Stats struct {
@@ -43,50 +53,98 @@ type Stats struct {
 	// so moving it before the rest in order to avoid alignment issue
 	LastBeat      int64
 	BannedAt      int64
+	BanTimeout    int64
 	ValidShares   int32
 	InvalidShares int32
 	Malformed     int32
 	ConnLimit     int32
 	Banned        int32
+	// Ban came from another instance, its origin publishes unban
+	RemoteBan int32
+}
+
+type offense struct {
+	count  int
+	lastAt int64
+}
+
+type banAction struct {
+	ip      string
+	reason  string
+	timeout time.Duration
+	unban   bool
+	// Received from another instance, must not be published again
+	remote bool
 }
 
 type PolicyServer struct {
 	sync.RWMutex
-	statsMu    sync.Mutex
-	config     *Config
-	stats      map[string]*Stats
-	banChannel chan string
-	startedAt  int64
-	grace      int64
-	timeout    int64
-	blacklist  []string
-	whitelist  []string
-	storage    *storage.RedisClient
-}
-
-func Start(cfg *Config, storage *storage.RedisClient) *PolicyServer {
-	s := &PolicyServer{config: cfg, startedAt: util.MakeTimestamp()}
+	statsMu       sync.Mutex
+	config        atomic.Value
+	name          string
+	stats         map[string]*Stats
+	offenses      map[string]*offense
+	offenseWindow int64
+	banner        Banner
+	banChannel    chan banAction
+	startedAt     int64
+	grace         int64
+	timeout       int64
+	blacklist     []string
+	whitelist     *ipMatcher
+	ipBlacklist   *ipMatcher
+	storage       *storage.RedisClient
+	quit          chan struct{}
+}
+
+func Start(cfg *Config, name string, storage *storage.RedisClient) *PolicyServer {
+	s := &PolicyServer{name: name, startedAt: util.MakeTimestamp()}
+	s.config.Store(cfg)
 	grace := util.MustParseDuration(cfg.Limits.Grace)
 	s.grace = int64(grace / time.Millisecond)
-	s.banChannel = make(chan string, 64)
+	s.banChannel = make(chan banAction, 64)
 	s.stats = make(map[string]*Stats)
+	s.offenses = make(map[string]*offense)
 	s.storage = storage
+	s.quit = make(chan struct{})
+
+	banner, err := newBanner(&cfg.Banning)
+	if err != nil {
+		log.Fatalf("Failed to set up banning: %v", err)
+	}
+	s.banner = banner
+	if cfg.Banning.Enabled && cfg.IPv6Prefix > 0 && cfg.IPv6Prefix < 128 {
+		if b, ok := banner.(prefixBanner); ok {
+			if err := b.CheckPrefixes(); err != nil {
+				log.Fatalf("Failed to set up banning: %v", err)
+			}
+		}
+	}
+	offenseWindow, err := parseOffenseWindow(&cfg.Banning)
+	if err != nil {
+		log.Fatalf("Failed to set up banning: %v", err)
+	}
+	s.offenseWindow = int64(offenseWindow / time.Millisecond)
 	s.refreshState()
 
-	timeout := util.MustParseDuration(s.config.ResetInterval)
+	timeout := util.MustParseDuration(s.cfg().ResetInterval)
 	s.timeout = int64(timeout / time.Millisecond)
 
-	resetIntv := util.MustParseDuration(s.config.ResetInterval)
+	resetIntv := util.MustParseDuration(s.cfg().ResetInterval)
 	resetTimer := time.NewTimer(resetIntv)
 	log.Printf("Set policy stats reset every %v", resetIntv)
 
-	refreshIntv := util.MustParseDuration(s.config.RefreshInterval)
+	refreshIntv := util.MustParseDuration(s.cfg().RefreshInterval)
 	refreshTimer := time.NewTimer(refreshIntv)
 	log.Printf("Set policy state refresh every %v", refreshIntv)
 
 	go func() {
 		for {
 			select {
+			case <-s.quit:
+				resetTimer.Stop()
+				refreshTimer.Stop()
+				return
 			case <-resetTimer.C:
 				s.resetStats()
 				resetTimer.Reset(resetIntv)
@@ -97,19 +155,123 @@ func Start(cfg *Config, storage *storage.RedisClient) *PolicyServer {
 		}
 	}()
 
-	for i := 0; i < s.config.Workers; i++ {
+	for i := 0; i < s.cfg().Workers; i++ {
 		s.startPolicyWorker()
 	}
-	log.Printf("Running with %v policy workers", s.config.Workers)
+	log.Printf("Running with %v policy workers", s.cfg().Workers)
+
+	if s.cfg().Banning.Enabled && s.cfg().Banning.Shared {
+		s.startSharedBans()
+	}
 	return s
 }
 
+func (s *PolicyServer) cfg() *Config {
+	return s.config.Load().(*Config)
+}
+
+// Reload applies limits and banning thresholds of new config. Workers, intervals,
+// IPv6 prefix, banning switch and ban backend are set up once on start and are not re-read.
+func (s *PolicyServer) Reload(cfg *Config) error {
+	grace, err := time.ParseDuration(cfg.Limits.Grace)
+	if err != nil {
+		return fmt.Errorf("invalid limits grace: %v", err)
+	}
+	offenseWindow, err := parseOffenseWindow(&cfg.Banning)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&s.grace, int64(grace/time.Millisecond))
+	atomic.StoreInt64(&s.offenseWindow, int64(offenseWindow/time.Millisecond))
+	s.config.Store(cfg)
+	return nil
+}
+
+// Escalation counts bans within offense window, so window is required with it
+func parseOffenseWindow(cfg *Banning) (time.Duration, error) {
+	var window time.Duration
+	if len(cfg.OffenseWindow) > 0 {
+		var err error
+		window, err = time.ParseDuration(cfg.OffenseWindow)
+		if err != nil {
+			return 0, fmt.Errorf("invalid banning offense window: %v", err)
+		}
+	}
+	if cfg.EscalationFactor > 1 && window <= 0 {
+		return 0, fmt.Errorf("banning offense window is required for escalation factor %v", cfg.EscalationFactor)
+	}
+	return window, nil
+}
+
+// Stop halts stats reset and state refresh timers
+func (s *PolicyServer) Stop() {
+	close(s.quit)
+}
+
+func (s *PolicyServer) startSharedBans() {
+	bans, err := s.storage.GetActiveBans()
+	if err != nil {
+		log.Printf("Failed to load shared bans from backend: %v", err)
+	}
+	for _, ban := range bans {
+		s.applySharedBan(ban)
+	}
+	log.Printf("Loaded %v shared bans", len(bans))
+
+	go func() {
+		for {
+			err := s.storage.SubscribeBans(func(ban *storage.Ban) {
+				if ban.Origin == s.name {
+					return
+				}
+				if ban.Unban {
+					s.dropSharedBan(ban)
+				} else {
+					s.applySharedBan(ban)
+				}
+			})
+			log.Printf("Shared bans subscription failed, retrying: %v", err)
+			time.Sleep(5 * time.Second)
+		}
+	}()
+}
+
+func (s *PolicyServer) applySharedBan(ban *storage.Ban) {
+	remaining := ban.ExpiresAt - util.MakeTimestamp()
+	if remaining <= 0 || s.InWhiteList(ban.IP) {
+		return
+	}
+	x := s.Get(ban.IP)
+	atomic.StoreInt64(&x.BannedAt, ban.BannedAt)
+	atomic.StoreInt64(&x.BanTimeout, ban.ExpiresAt-ban.BannedAt)
+	if atomic.CompareAndSwapInt32(&x.Banned, 0, 1) {
+		atomic.StoreInt32(&x.RemoteBan, 1)
+		log.Printf("Applying ban of %v from %s: %s", ban.IP, ban.Origin, ban.Reason)
+		timeout := time.Duration(remaining) * time.Millisecond
+		s.banChannel <- banAction{ip: ban.IP, reason: ban.Reason, timeout: timeout, remote: true}
+	}
+}
+
+func (s *PolicyServer) dropSharedBan(ban *storage.Ban) {
+	s.statsMu.Lock()
+	x, ok := s.stats[ban.IP]
+	s.statsMu.Unlock()
+	if !ok {
+		return
+	}
+	atomic.StoreInt64(&x.BannedAt, 0)
+	if atomic.CompareAndSwapInt32(&x.Banned, 1, 0) {
+		log.Printf("Ban of %v dropped by %s", ban.IP, ban.Origin)
+		s.banChannel <- banAction{ip: ban.IP, unban: true, remote: true}
+	}
+}
+
 func (s *PolicyServer) startPolicyWorker() {
 	go func() {
 		for {
 			select {
-			case ip := <-s.banChannel:
-				s.doBan(ip)
+			case action := <-s.banChannel:
+				s.doBan(action)
 			}
 		}
 	}()
@@ -117,7 +279,7 @@ func (s *PolicyServer) startPolicyWorker() {
 
 func (s *PolicyServer) resetStats() {
 	now := util.MakeTimestamp()
-	banningTimeout := s.config.Banning.Timeout * 1000
+	banningTimeout := s.cfg().Banning.Timeout * 1000
 	total := 0
 	s.statsMu.Lock()
 	defer s.statsMu.Unlock()
@@ -125,11 +287,17 @@ func (s *PolicyServer) resetStats() {
 	for key, m := range s.stats {
 		lastBeat := atomic.LoadInt64(&m.LastBeat)
 		bannedAt := atomic.LoadInt64(&m.BannedAt)
+		timeout := atomic.LoadInt64(&m.BanTimeout)
+		if timeout == 0 {
+			timeout = banningTimeout
+		}
 
-		if now-bannedAt >= banningTimeout {
+		if now-bannedAt >= timeout {
 			atomic.StoreInt64(&m.BannedAt, 0)
 			if atomic.CompareAndSwapInt32(&m.Banned, 1, 0) {
 				log.Printf("Ban dropped for %v", key)
+				remote := atomic.LoadInt32(&m.RemoteBan) == 1
+				s.banChannel <- banAction{ip: key, unban: true, remote: remote}
 				delete(s.stats, key)
 				total++
 			}
@@ -139,6 +307,11 @@ func (s *PolicyServer) resetStats() {
 			total++
 		}
 	}
+	for key, o := range s.offenses {
+		if now-o.lastAt >= atomic.LoadInt64(&s.offenseWindow) {
+			delete(s.offenses, key)
+		}
+	}
 	log.Printf("Flushed stats for %v IP addresses", total)
 }
 
@@ -151,22 +324,34 @@ func (s *PolicyServer) refreshState() {
 	if err != nil {
 		log.Printf("Failed to get blacklist from backend: %v", err)
 	}
-	s.whitelist, err = s.storage.GetWhitelist()
+	whitelist, err := s.storage.GetWhitelist()
 	if err != nil {
 		log.Printf("Failed to get whitelist from backend: %v", err)
 	}
-	log.Println("Policy state refresh complete")
+	s.whitelist = newIPMatcher(whitelist)
+	ipBlacklist, err := s.storage.GetIPBlacklist()
+	if err != nil {
+		log.Printf("Failed to get IP blacklist from backend: %v", err)
+	}
+	s.ipBlacklist = newIPMatcher(ipBlacklist)
+	log.Printf("Policy state refresh complete, %v whitelisted and %v blacklisted IP entries", s.whitelist.Len(), s.ipBlacklist.Len())
 }
 
 func (s *PolicyServer) NewStats() *Stats {
 	x := &Stats{
-		ConnLimit: s.config.Limits.Limit,
+		ConnLimit: s.cfg().Limits.Limit,
 	}
 	x.heartbeat()
 	return x
 }
 
+// Stats key of IP, IPv6 addresses are grouped by configured prefix
+func (s *PolicyServer) key(ip string) string {
+	return prefixKey(ip, s.cfg().IPv6Prefix)
+}
+
 func (s *PolicyServer) Get(ip string) *Stats {
+	ip = s.key(ip)
 	s.statsMu.Lock()
 	defer s.statsMu.Unlock()
 
@@ -182,20 +367,26 @@ func (s *PolicyServer) Get(ip string) *Stats {
 
 func (s *PolicyServer) BanClient(ip string) {
 	x := s.Get(ip)
-	s.forceBan(x, ip)
+	s.forceBan(x, ip, "manual")
 }
 
 func (s *PolicyServer) IsBanned(ip string) bool {
+	if s.InIPBlackList(ip) {
+		return true
+	}
+	if d, ok := s.banner.(*denyList); ok && d.Banned(s.key(ip)) {
+		return true
+	}
 	x := s.Get(ip)
 	return atomic.LoadInt32(&x.Banned) > 0
 }
 
 func (s *PolicyServer) ApplyLimitPolicy(ip string) bool {
-	if !s.config.Limits.Enabled {
+	if !s.cfg().Limits.Enabled {
 		return true
 	}
 	now := util.MakeTimestamp()
-	if now-s.startedAt > s.grace {
+	if now-s.startedAt > atomic.LoadInt64(&s.grace) {
 		return s.Get(ip).decrLimit() > 0
 	}
 	return true
@@ -204,7 +395,7 @@ func (s *PolicyServer) ApplyLimitPolicy(ip string) bool {
 func (s *PolicyServer) ApplyLoginPolicy(addy, ip string) bool {
 	if s.InBlackList(addy) {
 		x := s.Get(ip)
-		s.forceBan(x, ip)
+		s.forceBan(x, ip, "blacklisted login "+addy)
 		return false
 	}
 	return true
@@ -213,8 +404,8 @@ func (s *PolicyServer) ApplyLoginPolicy(addy, ip string) bool {
 func (s *PolicyServer) ApplyMalformedPolicy(ip string) bool {
 	x := s.Get(ip)
 	n := x.incrMalformed()
-	if n >= s.config.Banning.MalformedLimit {
-		s.forceBan(x, ip)
+	if n >= s.cfg().Banning.MalformedLimit {
+		s.forceBan(x, ip, "malformed requests")
 		return false
 	}
 	return true
@@ -226,15 +417,15 @@ func (s *PolicyServer) ApplySharePolicy(ip string, validShare bool) bool {
 
 	if validShare {
 		x.ValidShares++
-		if s.config.Limits.Enabled {
-			x.incrLimit(s.config.Limits.LimitJump)
+		if s.cfg().Limits.Enabled {
+			x.incrLimit(s.cfg().Limits.LimitJump)
 		}
 	} else {
 		x.InvalidShares++
 	}
 
 	totalShares := x.ValidShares + x.InvalidShares
-	if totalShares < s.config.Banning.CheckThreshold {
+	if totalShares < s.cfg().Banning.CheckThreshold {
 		x.Unlock()
 		return true
 	}
@@ -245,8 +436,8 @@ func (s *PolicyServer) ApplySharePolicy(ip string, validShare bool) bool {
 
 	ratio := invalidShares / validShares
 
-	if ratio >= s.config.Banning.InvalidPercent/100.0 {
-		s.forceBan(x, ip)
+	if ratio >= s.cfg().Banning.InvalidPercent/100.0 {
+		s.forceBan(x, ip, "invalid shares")
 		return false
 	}
 	return true
@@ -257,21 +448,51 @@ func (x *Stats) resetShares() {
 	x.InvalidShares = 0
 }
 
-func (s *PolicyServer) forceBan(x *Stats, ip string) {
-	if !s.config.Banning.Enabled || s.InWhiteList(ip) {
+func (s *PolicyServer) forceBan(x *Stats, ip, reason string) {
+	if !s.cfg().Banning.Enabled || s.InWhiteList(ip) {
 		return
 	}
+	ip = s.key(ip)
 	atomic.StoreInt64(&x.BannedAt, util.MakeTimestamp())
 
 	if atomic.CompareAndSwapInt32(&x.Banned, 0, 1) {
-		if len(s.config.Banning.IPSet) > 0 {
-			s.banChannel <- ip
-		} else {
-			log.Println("Banned peer", ip)
-		}
+		atomic.StoreInt32(&x.RemoteBan, 0)
+		timeout := s.banTimeout(ip)
+		atomic.StoreInt64(&x.BanTimeout, int64(timeout/time.Millisecond))
+		s.banChannel <- banAction{ip: ip, reason: reason, timeout: timeout}
 	}
 }
 
+// Escalates ban timeout for repeat offenders
+func (s *PolicyServer) banTimeout(ip string) time.Duration {
+	cfg := &s.cfg().Banning
+	timeout := float64(cfg.Timeout)
+
+	now := util.MakeTimestamp()
+	s.statsMu.Lock()
+	o, ok := s.offenses[ip]
+	// Offense older than window may still wait for stats reset
+	if !ok || now-o.lastAt >= atomic.LoadInt64(&s.offenseWindow) {
+		o = &offense{}
+		s.offenses[ip] = o
+	}
+	o.count++
+	o.lastAt = now
+	n := o.count
+	s.statsMu.Unlock()
+
+	if cfg.EscalationFactor > 1 {
+		timeout *= math.Pow(cfg.EscalationFactor, float64(n-1))
+	}
+	if cfg.MaxTimeout > 0 && timeout > float64(cfg.MaxTimeout) {
+		timeout = float64(cfg.MaxTimeout)
+	}
+	if n > 1 {
+		log.Printf("Repeated ban #%v for %v, timeout %vs", n, ip, int64(timeout))
+	}
+	return time.Duration(timeout) * time.Second
+}
+
 func (x *Stats) incrLimit(n int32) {
 	atomic.AddInt32(&x.ConnLimit, n)
 }
@@ -293,21 +514,43 @@ func (s *PolicyServer) InBlackList(addy string) bool {
 func (s *PolicyServer) InWhiteList(ip string) bool {
 	s.RLock()
 	defer s.RUnlock()
-	return util.StringInSlice(ip, s.whitelist)
+	return s.whitelist.Contains(ip)
 }
 
-func (s *PolicyServer) doBan(ip string) {
-	set, timeout := s.config.Banning.IPSet, s.config.Banning.Timeout
-	cmd := fmt.Sprintf("sudo ipset add %s %s timeout %v -!", set, ip, timeout)
-	args := strings.Fields(cmd)
-	head := args[0]
-	args = args[1:]
+func (s *PolicyServer) InIPBlackList(ip string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.ipBlacklist.Contains(ip)
+}
 
-	log.Printf("Banned %v with timeout %v on ipset %s", ip, timeout, set)
+func (s *PolicyServer) doBan(action banAction) {
+	var err error
+	if action.unban {
+		err = s.banner.Unban(action.ip)
+	} else {
+		err = s.banner.Ban(action.ip, action.timeout)
+	}
+	if err != nil {
+		log.Printf("Failed to update ban of %v: %v", action.ip, err)
+	}
+	if !s.cfg().Banning.Shared || action.remote {
+		return
+	}
 
-	_, err := exec.Command(head, args...).Output()
+	if action.unban {
+		err = s.storage.RemoveBan(action.ip, s.name)
+	} else {
+		now := util.MakeTimestamp()
+		err = s.storage.WriteBan(&storage.Ban{
+			IP:        action.ip,
+			Reason:    action.reason,
+			Origin:    s.name,
+			BannedAt:  now,
+			ExpiresAt: now + int64(action.timeout/time.Millisecond),
+		})
+	}
 	if err != nil {
-		log.Printf("CMD Error: %s", err)
+		log.Printf("Failed to share ban of %v: %v", action.ip, err)
 	}
 }
 
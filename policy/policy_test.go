@@ -0,0 +1,45 @@
+package policy
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestPolicy(banning Banning) *PolicyServer {
+	s := &PolicyServer{offenses: make(map[string]*offense)}
+	s.config.Store(&Config{Banning: banning})
+	window, err := parseOffenseWindow(&banning)
+	if err != nil {
+		panic(err)
+	}
+	s.offenseWindow = int64(window / time.Millisecond)
+	return s
+}
+
+func TestRepeatedBanIsEscalated(t *testing.T) {
+	s := newTestPolicy(Banning{Timeout: 1800, EscalationFactor: 4, MaxTimeout: 10000, OffenseWindow: "24h"})
+
+	for i, want := range []time.Duration{1800 * time.Second, 7200 * time.Second, 10000 * time.Second} {
+		if timeout := s.banTimeout("192.0.2.1"); timeout != want {
+			t.Errorf("ban #%v timeout %v, want %v", i+1, timeout, want)
+		}
+	}
+	if timeout := s.banTimeout("192.0.2.2"); timeout != 1800*time.Second {
+		t.Errorf("first ban of another IP timeout %v", timeout)
+	}
+
+	// Offense outside window is forgotten even before stats reset
+	s.offenses["192.0.2.1"].lastAt -= int64(25 * time.Hour / time.Millisecond)
+	if timeout := s.banTimeout("192.0.2.1"); timeout != 1800*time.Second {
+		t.Errorf("ban after offense window timeout %v, want 30m", timeout)
+	}
+}
+
+func TestEscalationRequiresOffenseWindow(t *testing.T) {
+	if _, err := parseOffenseWindow(&Banning{Timeout: 1800, EscalationFactor: 4}); err == nil {
+		t.Error("escalation without offense window is accepted")
+	}
+	if _, err := parseOffenseWindow(&Banning{Timeout: 1800, EscalationFactor: 1}); err != nil {
+		t.Errorf("no escalation without offense window: %v", err)
+	}
+}
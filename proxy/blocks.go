@@ -1,7 +1,7 @@
 package proxy
 
 import (
-	"fmt"
+	"context"
 	"log"
 	"math/big"
 	"sync"
@@ -16,9 +16,11 @@ import (
 
 const maxBacklog = 3
 
+// Node target and network difficulty of a job
 type heightDiffPair struct {
-	diff   *big.Int
-	height uint64
+	diff       *big.Int
+	difficulty *big.Int
+	height     uint64
 }
 
 type BlockTemplate struct {
@@ -28,6 +30,7 @@ type BlockTemplate struct {
 	Target               string
 	Difficulty           *big.Int
 	Height               uint64
+	Candidate            *rpc.CandidateResp
 	GetPendingBlockCache *rpc.GetBlockReplyPart
 	nonces               map[string]bool
 	headers              map[string]heightDiffPair
@@ -49,6 +52,10 @@ func (b Block) NumberU64() uint64        { return b.number }
 
 func (s *ProxyServer) fetchBlockTemplate() {
 	srpc := s.rpc()
+	if err := srpc.VerifyNetwork(); err != nil {
+		log.Printf("Not refreshing block template on %s: %v", srpc.Name, err)
+		return
+	}
 	t := s.currentBlockTemplate()
 	pendingReply, height, diff, err := s.fetchPendingBlock()
 	if err != nil {
@@ -56,31 +63,41 @@ func (s *ProxyServer) fetchBlockTemplate() {
 		return
 	}
 
-	reply, err := srpc.GetWork()
+	reply, err := srpc.GetWork(context.Background())
 	if err != nil {
 		log.Printf("Error while refreshing block template on %s: %s", srpc.Name, err)
 		return
 	}
+	if err := srpc.VerifyMiningPK(reply.PK); err != nil {
+		log.Printf("ALERT: %v, refusing its work. Block rewards would not go to the pool!", err)
+		return
+	}
 	// No need to update, we have fresh job
 	if t != nil && t.Header == reply.Msg {
 		return
 	}
 
-	pendingReply.Target = util.ToHex(s.config.Proxy.Difficulty)
+	pendingReply.Target = util.ToHex(s.difficulty().diff)
+	// Candidate height is the block being mined, node info only knows chain tip
+	if reply.Height > 0 {
+		height = reply.Height
+	}
 
 	newTemplate := BlockTemplate{
 		Header:               reply.Msg,
 		Seed:                 reply.PK,
 		Target:               reply.Target.String(),
 		Height:               height,
-		Difficulty:           new(big.Int).SetUint64(diff),
+		Candidate:            reply,
+		Difficulty:           diff,
 		GetPendingBlockCache: pendingReply,
 		headers:              make(map[string]heightDiffPair),
 	}
 	// Copy job backlog and add current one
 	newTemplate.headers[reply.Msg] = heightDiffPair{
-		diff:   reply.Target,
-		height: height,
+		diff:       reply.Target,
+		difficulty: diff,
+		height:     height,
 	}
 	if t != nil {
 		for k, v := range t.headers {
@@ -90,6 +107,7 @@ func (s *ProxyServer) fetchBlockTemplate() {
 		}
 	}
 	s.blockTemplate.Store(&newTemplate)
+	s.notifyNewTemplate()
 	log.Printf("New block to mine on %s at height %d / %s", srpc.Name, height, reply.Msg[0:10])
 
 	// Stratum
@@ -98,41 +116,31 @@ func (s *ProxyServer) fetchBlockTemplate() {
 	//}
 }
 
-func (s *ProxyServer) fetchPendingBlock() (*rpc.GetBlockReplyPart, uint64, uint64, error) {
-	srpc := s.rpc()
-	//info, err := srpc.GetPendingBlock()
-	info := srpc.GetInfo()
-	work, _ := srpc.GetWork()
-	//if err != nil {
-	//	log.Printf("Error while refreshing pending block on %s: %s", srpc.Name, err)
-	//	return nil, 0, 0, err
-	//}
-	//blockNumber, err := strconv.ParseUint(strings.Replace(info["headersHeight"].(string), "0x", "", -1), 16, 64)
-	blockNumber, ok := info["headersHeight"].(float64)
-	if !ok {
-		fmt.Println("failed to get header height info")
-	}
+// Channel is closed once next template is stored
+func (s *ProxyServer) templateChanged() <-chan struct{} {
+	s.templateMu.Lock()
+	defer s.templateMu.Unlock()
+	return s.templateCh
+}
 
-	diff, ok := info["difficulty"].(float64)
-	if !ok {
-		fmt.Println("failed to get header diff info")
-	}
-	//if err != nil {
-	//	log.Println("Can't parse pending block number")
-	//	return nil, 0, 0, err
-	//}
+func (s *ProxyServer) notifyNewTemplate() {
+	s.templateMu.Lock()
+	close(s.templateCh)
+	s.templateCh = make(chan struct{})
+	s.templateMu.Unlock()
+}
 
-	//if err != nil {
-	//	log.Println("Can't parse pending block difficulty")
-	//	return nil, 0, 0, err
-	//}
+func (s *ProxyServer) fetchPendingBlock() (*rpc.GetBlockReplyPart, uint64, *big.Int, error) {
+	info, err := s.rpc().GetInfo(context.Background())
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	diff := info.Difficulty
+	if diff == nil {
+		diff = new(big.Int)
+	}
 	reply := &rpc.GetBlockReplyPart{
-		Number: hexutil.EncodeUint64(uint64(blockNumber)),
-		Target: hexutil.EncodeUint64(work.Target.Uint64()),
+		Number: hexutil.EncodeUint64(uint64(info.HeadersHeight)),
 	}
-
-	// maxUint64 := new(big.Int).Exp(big.NewInt(2), big.NewInt(64), big.NewInt(0))
-	// diff := new(big.Int).Div(maxUint64, work.Target)
-
-	return reply, uint64(blockNumber), uint64(diff), nil
+	return reply, uint64(info.HeadersHeight), diff, nil
 }
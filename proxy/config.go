@@ -9,10 +9,13 @@ import (
 
 type Config struct {
 	Name                  string        `json:"name"`
+	Network               string        `json:"network"`
 	Proxy                 Proxy         `json:"proxy"`
 	Api                   api.ApiConfig `json:"api"`
 	Upstream              []Upstream    `json:"upstream"`
 	UpstreamCheckInterval string        `json:"upstreamCheckInterval"`
+	UpstreamMaxLag        int64         `json:"upstreamMaxLag"`
+	UpstreamSwitchChecks  int           `json:"upstreamSwitchChecks"`
 
 	Threads int `json:"threads"`
 
@@ -35,11 +38,18 @@ type Proxy struct {
 	LimitBodySize        int64  `json:"limitBodySize"`
 	BehindReverseProxy   bool   `json:"behindReverseProxy"`
 	BlockRefreshInterval string `json:"blockRefreshInterval"`
+	LongPollTimeout      string `json:"longPollTimeout"`
 	Difficulty           int64  `json:"difficulty"`
+	MinDifficulty        int64  `json:"minDifficulty"`
+	MaxDifficulty        int64  `json:"maxDifficulty"`
+	MiningPubKey         string `json:"miningPubKey"`
+	MiningAddress        string `json:"miningAddress"`
+	Solo                 bool   `json:"solo"`
 	StateUpdateInterval  string `json:"stateUpdateInterval"`
 	HashrateExpiration   string `json:"hashrateExpiration"`
 
-	Policy policy.Config `json:"policy"`
+	Policy  policy.Config         `json:"policy"`
+	Journal storage.JournalConfig `json:"journal"`
 
 	MaxFails    int64 `json:"maxFails"`
 	HealthCheck bool  `json:"healthCheck"`
@@ -57,5 +67,6 @@ type Stratum struct {
 type Upstream struct {
 	Name    string `json:"name"`
 	Url     string `json:"url"`
+	ApiKey  string `json:"apiKey"`
 	Timeout string `json:"timeout"`
 }
@@ -1,9 +1,13 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"log"
-	"math/big"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/maoxs2/ergoPool/rpc"
 )
@@ -11,28 +15,115 @@ import (
 // Allow only lowercase hexadecimal with 0x prefix
 var noncePattern = regexp.MustCompile("^0x[0-9a-f]{16}$")
 var hashPattern = regexp.MustCompile("^0x[0-9a-f]{64}$")
+
+// Base58 alphabet, address itself is validated with checksum on every request
+const loginPattern = "[1-9A-HJ-NP-Za-km-z]+"
+
+// Login may carry static difficulty hint as login+diff
+const loginRoutePattern = loginPattern + `(?:\+[0-9]{1,18})?`
+
+var pubKeyPattern = regexp.MustCompile("^0[23][0-9a-fA-F]{64}$")
 var workerPattern = regexp.MustCompile("^[0-9a-zA-Z-_]{1,4}$")
 
-func (s *ProxyServer) handleGetWorkRPC(cs *Session) (map[string]string, *ErrorReply) {
+func (s *ProxyServer) handleGetWorkRPC(cs *Session) (map[string]interface{}, *ErrorReply) {
 	t := s.currentBlockTemplate()
 	if t == nil || len(t.Header) == 0 || s.isSick() {
 		return nil, &ErrorReply{Code: 0, Message: "Work not ready"}
 	}
-	// var b64 [8]byte
-	// copy(b64[:], t.Difficulty.Bytes())
 
-	twoExp256 := new(big.Int).Exp(big.NewInt(2), big.NewInt(256), big.NewInt(0))
-	maxUint256 := twoExp256.Sub(twoExp256, big.NewInt(1))
-	confDiff := new(big.Int).SetUint64(uint64(s.config.Proxy.Difficulty))
-	target := new(big.Int).Div(maxUint256, confDiff)
+	target := shareTarget(cs.diff)
 
-	// fmt.Println(t.Difficulty)
+	// Same shape as node candidate, but with share target
+	reply := make(map[string]interface{})
+	c := t.Candidate
+	for k, v := range c.Extra {
+		reply[k] = v
+	}
+	reply["msg"] = c.Msg
+	reply["b"] = target
+	reply["pk"] = c.PK
+	if c.Height > 0 {
+		reply["h"] = c.Height
+	}
+	if len(c.Proof) > 0 {
+		reply["proof"] = c.Proof
+	}
+	return reply, nil
+}
 
-	return map[string]string{
-		"msg": t.Header,
-		"b":   target.String(),
-		"pk":  t.Seed,
-	}, nil
+// Splits optional difficulty hint off login
+func splitLogin(s string) (string, string) {
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// Share difficulty settings, replaced as a whole on config reload
+type difficultyLimits struct {
+	diff int64
+	min  int64
+	max  int64
+}
+
+func newDifficultyLimits(cfg *Proxy) (*difficultyLimits, error) {
+	limits := &difficultyLimits{diff: cfg.Difficulty, min: cfg.MinDifficulty, max: cfg.MaxDifficulty}
+	if limits.diff <= 0 {
+		return nil, errors.New("difficulty must be positive")
+	}
+	if limits.min <= 0 {
+		limits.min = limits.diff
+	}
+	if limits.max <= 0 {
+		limits.max = limits.diff
+	}
+	if limits.max < limits.min {
+		return nil, errors.New("maxDifficulty must not be lower than minimal share difficulty")
+	}
+	return limits, nil
+}
+
+func (s *ProxyServer) difficulty() *difficultyLimits {
+	return s.difficultyLimits.Load().(*difficultyLimits)
+}
+
+// Miner chosen difficulty clamped to pool limits, pool difficulty if hint is absent or malformed
+func (s *ProxyServer) shareDifficulty(hint string) int64 {
+	limits := s.difficulty()
+	if len(hint) == 0 {
+		return limits.diff
+	}
+	v, err := strconv.ParseInt(hint, 10, 64)
+	if err != nil || v <= 0 {
+		return limits.diff
+	}
+	if v < limits.min {
+		return limits.min
+	}
+	if v > limits.max {
+		return limits.max
+	}
+	return v
+}
+
+// Holds long-poll request while miner already has current work
+func (s *ProxyServer) waitForNewWork(ctx context.Context, lastMsg string) {
+	if s.longPollTimeout == 0 {
+		return
+	}
+	changed := s.templateChanged()
+	t := s.currentBlockTemplate()
+	if t == nil || t.Header != lastMsg {
+		return
+	}
+	timer := time.NewTimer(s.longPollTimeout)
+	defer timer.Stop()
+	select {
+	case <-changed:
+	case <-timer.C:
+	case <-ctx.Done():
+	case <-s.quit:
+	}
 }
 
 func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params *rpc.SolutionReq) (bool, *ErrorReply) {
@@ -52,14 +143,23 @@ func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params *rpc
 	//	return false, &ErrorReply{Code: -1, Message: "Malformed PoW result"}
 	//}
 
+	s.submitMu.RLock()
+	defer s.submitMu.RUnlock()
+	if s.stopping {
+		return false, &ErrorReply{Code: 0, Message: "Pool is shutting down"}
+	}
+
 	t := s.currentBlockTemplate()
-	exist, validShare := s.processShare(login, id, cs.ip, t, params)
+	exist, validShare, errReply := s.processShare(login, id, cs.ip, cs.solo, cs.diff, t, params)
 	ok := s.policy.ApplySharePolicy(cs.ip, !exist && validShare)
 
 	if exist {
 		log.Printf("Duplicate share from %s@%s %v", login, cs.ip, params)
 		return false, &ErrorReply{Code: 22, Message: "Duplicate share"}
 	}
+	if errReply != nil {
+		return validShare, errReply
+	}
 
 	if !validShare {
 		log.Printf("Invalid share from %s@%s", login, cs.ip)
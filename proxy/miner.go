@@ -1,51 +1,211 @@
 package proxy
 
 import (
-	"github.com/maoxs2/ergoPool/rpc"
+	"context"
+	"encoding/hex"
 	"log"
+	"math/big"
+	"time"
 
+	"github.com/maoxs2/ergoPool/ergo"
+	"github.com/maoxs2/ergoPool/rpc"
+	"github.com/maoxs2/ergoPool/storage"
+	"github.com/maoxs2/ergoPool/util"
 )
 
-func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, params *rpc.SolutionReq) (bool, bool) {
+func (s *ProxyServer) processShare(login, id, ip string, solo bool, shareDiff int64, t *BlockTemplate, params *rpc.SolutionReq) (bool, bool, *ErrorReply) {
 	//nonceHex := params[0]
 	//hashNoNonce := params[1]
 	hashNoNonce := t.Header
 	//mixDigest := params[2]
 	//nonce, _ := strconv.ParseUint(strings.Replace(nonceHex, "0x", "", -1), 16, 64)
-	shareDiff := s.config.Proxy.Difficulty
 
 	//maxUint256 := new(big.Int).Exp(big.NewInt(2), big.NewInt(256), big.NewInt(0))
 
 	h, ok := t.headers[hashNoNonce]
 	if !ok {
 		log.Printf("Stale share from %v@%v", login, ip)
-		return false, false
+		return false, false, &ErrorReply{Code: 21, Message: "Stale share"}
+	}
+
+	share := &storage.Share{
+		Login:     login,
+		Worker:    id,
+		Params:    params,
+		Diff:      shareDiff,
+		Height:    h.height,
+		Header:    t.Header,
+		Solo:      solo,
+		Timestamp: util.MakeTimestamp(),
 	}
 
-	ok, err := s.rpc().SubmitSolution(params)
+	hit, err := shareHit(hashNoNonce, h.height, params)
 	if err != nil {
-		log.Printf("Block submission failure at height %v for %v: %v", h.height, t.Header, err)
-	} else if !ok {
-		log.Printf("Block rejected at height %v for %v", h.height, t.Header)
+		log.Printf("Malformed solution from %v@%v: %v", login, ip, err)
+		return false, false, nil
+	}
+	if hit.Cmp(shareTarget(shareDiff)) >= 0 {
+		log.Printf("Share above target from %v@%v at height %v", login, ip, h.height)
+		return false, false, nil
+	}
+
+	var errReply *ErrorReply
+	if hit.Cmp(h.diff) < 0 {
+		var status rpc.SubmitStatus
+		share.Nodes, status = s.broadcastSolution(h.height, params)
+		switch status {
+		case rpc.SubmitAccepted:
+			s.fetchBlockTemplate()
+			share.Block = true
+			share.RoundDiff = h.difficulty
+			if solo {
+				log.Printf("Solo block found by miner %v@%v at height %d, accepted by %v", login, ip, h.height, share.Nodes)
+			} else {
+				log.Printf("Block found by miner %v@%v at height %d, accepted by %v", login, ip, h.height, share.Nodes)
+			}
+		case rpc.SubmitInvalid:
+			// Node knows better, share is not credited
+			log.Printf("Invalid block from %v@%v at height %v for %v", login, ip, h.height, t.Header)
+			return false, false, &ErrorReply{Code: 23, Message: "Invalid block solution"}
+		case rpc.SubmitStale:
+			log.Printf("Stale block from %v@%v at height %v for %v", login, ip, h.height, t.Header)
+			errReply = &ErrorReply{Code: 21, Message: "Block solution is stale"}
+		default:
+			log.Printf("Block from %v@%v at height %v was not accepted by any upstream", login, ip, h.height)
+			errReply = &ErrorReply{Code: 20, Message: "Node error, block solution not accepted"}
+		}
+	}
+
+	if s.journal != nil {
+		err := s.journal.Append(share)
+		if err != nil {
+			log.Printf("Failed to append share to journal: %v", err)
+			s.writeShareData(share, false)
+		}
 	} else {
-		s.fetchBlockTemplate()
-		_, err := s.backend.WriteBlock(login, id, params, shareDiff, h.diff.Int64(), h.height, s.hashrateExpiration, t.Header)
+		s.writeShareData(share, false)
+	}
+
+	return false, true, errReply
+}
+
+type submitResult struct {
+	name    string
+	result  *rpc.SubmitResult
+	err     error
+	latency time.Duration
+}
+
+// Submits block solution to every healthy upstream at once. Returns on first node that accepted it,
+// remaining results are only logged. Without acceptance status is stale over invalid over node error.
+func (s *ProxyServer) broadcastSolution(height uint64, params *rpc.SolutionReq) ([]string, rpc.SubmitStatus) {
+	upstreams, current := s.upstreamList()
+	results := make(chan submitResult, len(upstreams))
+	n := 0
+	for _, v := range upstreams {
+		// Current upstream may be marked sick just now, but it issued this work
+		if v != current && v.Sick() {
+			continue
+		}
+		n++
+		go func(r *rpc.RPCClient) {
+			start := time.Now()
+			result, err := r.SubmitSolution(context.Background(), params)
+			results <- submitResult{name: r.Name, result: result, err: err, latency: time.Since(start)}
+		}(v)
+	}
+
+	status := rpc.SubmitNodeError
+	for i := 0; i < n; i++ {
+		res := <-results
+		switch logSubmitResult(height, res) {
+		case rpc.SubmitAccepted:
+			// Slow nodes must not hold miner's reply and block candidate
+			go func(left int) {
+				for ; left > 0; left-- {
+					logSubmitResult(height, <-results)
+				}
+			}(n - i - 1)
+			return []string{res.name}, rpc.SubmitAccepted
+		case rpc.SubmitStale:
+			status = rpc.SubmitStale
+		case rpc.SubmitInvalid:
+			if status == rpc.SubmitNodeError {
+				status = rpc.SubmitInvalid
+			}
+		}
+	}
+	return nil, status
+}
+
+func logSubmitResult(height uint64, res submitResult) rpc.SubmitStatus {
+	if res.err != nil {
+		log.Printf("Block submission to %v failed at height %v in %v: %v", res.name, height, res.latency, res.err)
+		return rpc.SubmitNodeError
+	}
+	switch res.result.Status {
+	case rpc.SubmitAccepted:
+		log.Printf("Block accepted by %v at height %v in %v", res.name, height, res.latency)
+	case rpc.SubmitStale:
+		log.Printf("Block rejected by %v as stale at height %v in %v: %v", res.name, height, res.latency, res.result.Detail)
+	case rpc.SubmitInvalid:
+		log.Printf("Block rejected by %v as invalid at height %v in %v: %v", res.name, height, res.latency, res.result.Detail)
+	}
+	return res.result.Status
+}
+
+// Writes share or block candidate to backend, retried writes are checked for duplicates first
+func (s *ProxyServer) writeShareData(share *storage.Share, retry bool) error {
+	if retry {
+		exist, err := s.backend.IsShareWritten(share.Id)
+		if err != nil {
+			return err
+		}
+		if exist {
+			log.Printf("Skipping already written share %v from %v", share.Id, share.Login)
+			return nil
+		}
+	}
+
+	if share.Block {
+		_, err := s.backend.WriteBlock(share, s.hashrateExpiration)
 		// if exist {
 		// 	return true, false
 		// }
 		if err != nil {
 			log.Println("Failed to insert block candidate into backend:", err)
-		} else {
-			log.Printf("Inserted block %v to backend", h.height)
+			return err
 		}
-		log.Printf("Block found by miner %v@%v at height %d", login, ip, h.height)
-		// return false, true
+		log.Printf("Inserted block %v to backend", share.Height)
+		return nil
 	}
 
-	_, err = s.backend.WriteShare(login, id, params, shareDiff, h.height, s.hashrateExpiration)
+	_, err := s.backend.WriteShare(share, s.hashrateExpiration)
 	if err != nil {
 		log.Println("Failed to insert share data into backend:", err)
 	}
+	return err
+}
+
+// Autolykos v1 miners send hit as d, v2 hit is computed from header msg and nonce
+func shareHit(msgHex string, height uint64, params *rpc.SolutionReq) (*big.Int, error) {
+	if params.D != nil {
+		return params.D, nil
+	}
+	msg, err := hex.DecodeString(msgHex)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(params.N)
+	if err != nil {
+		return nil, err
+	}
+	return ergo.Hit(msg, nonce, uint32(height))
+}
 
-	return false, true
+// Same target as given to miner in work
+func shareTarget(diff int64) *big.Int {
+	twoExp256 := new(big.Int).Exp(big.NewInt(2), big.NewInt(256), big.NewInt(0))
+	maxUint256 := twoExp256.Sub(twoExp256, big.NewInt(1))
+	return new(big.Int).Div(maxUint256, big.NewInt(diff))
 }
@@ -1,18 +1,22 @@
 package proxy
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"math/big"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
 
+	"github.com/maoxs2/ergoPool/ergo"
 	"github.com/maoxs2/ergoPool/policy"
 	"github.com/maoxs2/ergoPool/rpc"
 	"github.com/maoxs2/ergoPool/storage"
@@ -22,13 +26,39 @@ import (
 type ProxyServer struct {
 	config             *Config
 	blockTemplate      atomic.Value
+	templateMu         sync.Mutex
+	templateCh         chan struct{}
+	longPollTimeout    time.Duration
 	upstream           int32
+	upstreamsMu        sync.RWMutex
 	upstreams          []*rpc.RPCClient
+	upstreamCfgs       []Upstream
+	miningPK           string
+	difficultyLimits   atomic.Value
 	backend            *storage.RedisClient
+	journal            *storage.Journal
+	network            ergo.NetworkType
 	diff               string
 	policy             *policy.PolicyServer
 	hashrateExpiration time.Duration
 	failsCount         int64
+	srv                *http.Server
+	quit               chan struct{}
+
+	// Held for reading while share is processed, shutdown takes it to drain submits
+	submitMu sync.RWMutex
+	stopping bool
+
+	// Upstream selection state, touched only by upstream check goroutine
+	bestHeight      int64
+	lagging         int32
+	maxLag          int64
+	preferred       int
+	preferredChecks int
+
+	// Rejected requests since start, reported with node state
+	blacklistedCount int64
+	limitedCount     int64
 
 	// Stratum
 	sessionsMu sync.RWMutex
@@ -37,8 +67,10 @@ type ProxyServer struct {
 }
 
 type Session struct {
-	ip  string
-	enc *json.Encoder
+	ip   string
+	enc  *json.Encoder
+	solo bool
+	diff int64
 
 	// Stratum
 	sync.Mutex
@@ -46,22 +78,55 @@ type Session struct {
 	login string
 }
 
-func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
+func NewProxy(cfg *Config, network ergo.NetworkType, backend *storage.RedisClient) *ProxyServer {
 	if len(cfg.Name) == 0 {
 		log.Fatal("You must set instance name")
 	}
-	policy := policy.Start(&cfg.Proxy.Policy, backend)
+	policy := policy.Start(&cfg.Proxy.Policy, cfg.Name, backend)
 
-	proxy := &ProxyServer{config: cfg, backend: backend, policy: policy}
+	proxy := &ProxyServer{config: cfg, network: network, backend: backend, policy: policy}
 	proxy.diff = util.GetTargetHex(cfg.Proxy.Difficulty)
+	limits, err := newDifficultyLimits(&cfg.Proxy)
+	if err != nil {
+		log.Fatalf("Invalid share difficulty: %v", err)
+	}
+	proxy.difficultyLimits.Store(limits)
+	proxy.templateCh = make(chan struct{})
+	proxy.quit = make(chan struct{})
+	if len(cfg.Proxy.LongPollTimeout) > 0 {
+		proxy.longPollTimeout = util.MustParseDuration(cfg.Proxy.LongPollTimeout)
+		log.Printf("Long polling for new work up to %v", proxy.longPollTimeout)
+	}
+
+	miningPK, err := PoolMiningPK(&cfg.Proxy, network)
+	if err != nil {
+		log.Fatalf("Invalid pool mining key: %v", err)
+	}
+	proxy.miningPK = miningPK
 
 	proxy.upstreams = make([]*rpc.RPCClient, len(cfg.Upstream))
+	proxy.upstreamCfgs = cfg.Upstream
 	for i, v := range cfg.Upstream {
-		proxy.upstreams[i] = rpc.NewRPCClient(v.Name, v.Url, v.Timeout)
 		log.Printf("Upstream: %s => %s", v.Name, v.Url)
+		proxy.upstreams[i], err = proxy.newUpstream(v)
+		if err != nil {
+			log.Fatalf("Refusing to start proxy: %v", err)
+		}
+		// Unreachable upstream stays sick, one on another network stops the pool
+		if err := proxy.upstreams[i].CheckNetwork(network.String()); err != nil {
+			log.Fatalf("Refusing to start proxy: %v", err)
+		}
 	}
 	log.Printf("Default upstream: %s => %s", proxy.rpc().Name, proxy.rpc().Url)
 
+	proxy.maxLag = cfg.UpstreamMaxLag
+	if proxy.maxLag <= 0 {
+		proxy.maxLag = 2
+	}
+	if cfg.UpstreamSwitchChecks <= 0 {
+		cfg.UpstreamSwitchChecks = 3
+	}
+
 	//if cfg.Proxy.Stratum.Enabled {
 	//	proxy.sessions = make(map[*Session]struct{})
 	//	go proxy.ListenTCP()
@@ -71,6 +136,16 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 
 	proxy.hashrateExpiration = util.MustParseDuration(cfg.Proxy.HashrateExpiration)
 
+	if cfg.Proxy.Journal.Enabled {
+		journal, err := storage.NewJournal(&cfg.Proxy.Journal, backend, proxy.writeShareData)
+		if err != nil {
+			log.Fatalf("Failed to open share journal: %v", err)
+		}
+		proxy.journal = journal
+		proxy.journal.Start()
+		log.Printf("Journaling shares to %s", cfg.Proxy.Journal.Path)
+	}
+
 	refreshIntv := util.MustParseDuration(cfg.Proxy.BlockRefreshInterval)
 	refreshTimer := time.NewTimer(refreshIntv)
 	log.Printf("Set block refresh every %v", refreshIntv)
@@ -84,6 +159,9 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 	go func() {
 		for {
 			select {
+			case <-proxy.quit:
+				refreshTimer.Stop()
+				return
 			case <-refreshTimer.C:
 				proxy.fetchBlockTemplate()
 				refreshTimer.Reset(refreshIntv)
@@ -94,6 +172,9 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 	go func() {
 		for {
 			select {
+			case <-proxy.quit:
+				checkTimer.Stop()
+				return
 			case <-checkTimer.C:
 				proxy.checkUpstreams()
 				checkTimer.Reset(checkIntv)
@@ -104,10 +185,20 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 	go func() {
 		for {
 			select {
+			case <-proxy.quit:
+				stateUpdateTimer.Stop()
+				return
 			case <-stateUpdateTimer.C:
 				t := proxy.currentBlockTemplate()
 				if t != nil {
-					err := backend.WriteNodeState(cfg.Name, t.Height, t.Difficulty)
+					rejects := map[string]int64{
+						"blacklisted": atomic.LoadInt64(&proxy.blacklistedCount),
+						"limited":     atomic.LoadInt64(&proxy.limitedCount),
+					}
+					err := backend.WriteNodeState(cfg.Name, t.Height, t.Difficulty, rejects)
+					if err == nil {
+						err = backend.WriteUpstreamStates(cfg.Name, proxy.upstreamStates())
+					}
 					if err != nil {
 						log.Printf("Failed to write node state to backend: %v", err)
 						proxy.markSick()
@@ -120,49 +211,217 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 		}
 	}()
 
+	proxy.srv = proxy.newServer()
 	return proxy
 }
 
+// Mining pk from either hex key or P2PK address, one of them is required
+func PoolMiningPK(cfg *Proxy, network ergo.NetworkType) (string, error) {
+	if len(cfg.MiningAddress) > 0 {
+		if err := network.ValidateAddress(cfg.MiningAddress); err != nil {
+			return "", err
+		}
+		addr, _ := ergo.ParseAddress(cfg.MiningAddress)
+		pk, err := addr.PubKeyHex()
+		if err != nil {
+			return "", err
+		}
+		if len(cfg.MiningPubKey) > 0 && !strings.EqualFold(cfg.MiningPubKey, pk) {
+			return "", fmt.Errorf("miningPubKey does not match miningAddress")
+		}
+		return pk, nil
+	}
+	if len(cfg.MiningPubKey) == 0 {
+		return "", fmt.Errorf("miningAddress or miningPubKey is required")
+	}
+	if !pubKeyPattern.MatchString(cfg.MiningPubKey) {
+		return "", fmt.Errorf("miningPubKey must be 33 bytes compressed key in hex")
+	}
+	return cfg.MiningPubKey, nil
+}
+
 func (s *ProxyServer) Start() {
 	log.Printf("Starting proxy on %v", s.config.Proxy.Listen)
+	err := s.srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Failed to start proxy: %v", err)
+	}
+}
+
+// Shutdown stops accepting work, waits for in-flight submits and flushes share journal
+func (s *ProxyServer) Shutdown(ctx context.Context) error {
+	log.Println("Stopping proxy")
+	// Stops timers and releases long-polling miners
+	close(s.quit)
+	err := s.srv.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Proxy listener did not close in time: %v", err)
+	}
+	// Handlers may outlive listener shutdown on timeout, shares they hold must reach journal
+	s.submitMu.Lock()
+	s.stopping = true
+	s.submitMu.Unlock()
+
+	s.policy.Stop()
+	if s.journal != nil {
+		if jerr := s.journal.Close(); jerr != nil {
+			log.Printf("Failed to close share journal: %v", jerr)
+		}
+	}
+	log.Println("Proxy stopped")
+	return err
+}
+
+func (s *ProxyServer) newServer() *http.Server {
 	r := mux.NewRouter()
-	r.Handle("/{login:[0-9a-zA-Z]{51}}/{id:[0-9a-zA-Z-_]{1,4}}/mining/candidate", s)
-	r.Handle("/{login}/{id:[0-9a-zA-Z-_]{1,4}}/mining/candidate", s)
-	r.Handle("/{login:[0-9a-zA-Z]{51}}/{id:[0-9a-zA-Z-_]{1,4}}/mining/solution", s)
-	r.Handle("/{login:[0-9a-zA-Z]{51}}/mining/candidate", s)
-	r.Handle("/{login}/mining/candidate", s)
-	r.Handle("/{login:[0-9a-zA-Z]{51}}/mining/solution", s)
-	srv := &http.Server{
+	prefixes := []string{""}
+	if s.config.Proxy.Solo {
+		prefixes = append(prefixes, "/solo")
+	}
+	login := "/{login:" + loginRoutePattern + "}"
+	id := "/{id:[0-9a-zA-Z-_]{1,4}}"
+	diff := "/{diff:[0-9]{1,18}}"
+	for _, prefix := range prefixes {
+		for _, path := range []string{login + id + diff, login + id, login} {
+			r.Handle(prefix+path+"/mining/candidate", s)
+			r.Handle(prefix+path+"/mining/solution", s)
+		}
+	}
+	return &http.Server{
 		Addr:           s.config.Proxy.Listen,
 		Handler:        r,
 		MaxHeaderBytes: s.config.Proxy.LimitHeadersSize,
 	}
-	err := srv.ListenAndServe()
-	if err != nil {
-		log.Fatalf("Failed to start proxy: %v", err)
-	}
 }
 
 func (s *ProxyServer) rpc() *rpc.RPCClient {
+	s.upstreamsMu.RLock()
+	defer s.upstreamsMu.RUnlock()
 	i := atomic.LoadInt32(&s.upstream)
 	return s.upstreams[i]
 }
 
+// Upstream list and current upstream at once, list may be replaced on config reload
+func (s *ProxyServer) upstreamList() ([]*rpc.RPCClient, *rpc.RPCClient) {
+	s.upstreamsMu.RLock()
+	defer s.upstreamsMu.RUnlock()
+	i := atomic.LoadInt32(&s.upstream)
+	return s.upstreams, s.upstreams[i]
+}
+
+func (s *ProxyServer) newUpstream(v Upstream) (*rpc.RPCClient, error) {
+	if _, err := time.ParseDuration(v.Timeout); err != nil {
+		return nil, fmt.Errorf("invalid timeout of upstream %s: %v", v.Name, err)
+	}
+	r := rpc.NewRPCClient(v.Name, v.Url, v.ApiKey, v.Timeout)
+	r.SetMiningPK(s.miningPK)
+	// Checked by health check before use, so reload never waits for node
+	r.SetNetwork(s.network.String())
+	return r, nil
+}
+
+// Upstream is switched only when current one can't serve work, or when
+// better upstream stays preferred for several checks in a row
 func (s *ProxyServer) checkUpstreams() {
-	candidate := int32(0)
-	backup := false
+	// Checks query nodes, so they run on a copy without holding the lock
+	s.upstreamsMu.RLock()
+	upstreams := make([]*rpc.RPCClient, len(s.upstreams))
+	copy(upstreams, s.upstreams)
+	s.upstreamsMu.RUnlock()
+
+	checked := make(map[*rpc.RPCClient]bool, len(upstreams))
+	for _, v := range upstreams {
+		checked[v] = v.Check()
+	}
 
+	// Upstreams added by reload meanwhile are not alive until next check
+	s.upstreamsMu.Lock()
+	defer s.upstreamsMu.Unlock()
+
+	best := int64(0)
+	alive := make([]bool, len(s.upstreams))
+	for i, v := range s.upstreams {
+		alive[i] = checked[v]
+		if h := v.Status().FullHeight; alive[i] && h > best {
+			best = h
+		}
+	}
+	atomic.StoreInt64(&s.bestHeight, best)
+
+	eligible := func(i int) bool {
+		status := s.upstreams[i].Status()
+		return alive[i] && status.Synced(s.maxLag) && best-status.FullHeight <= s.maxLag
+	}
+
+	preferred := -1
 	for i, v := range s.upstreams {
-		if v.Check() && !backup {
-			candidate = int32(i)
-			backup = true
+		if !eligible(i) {
+			continue
 		}
+		if preferred < 0 || betterUpstream(v.Status(), s.upstreams[preferred].Status()) {
+			preferred = i
+		}
+	}
+
+	current := int(atomic.LoadInt32(&s.upstream))
+	if preferred < 0 {
+		if atomic.CompareAndSwapInt32(&s.lagging, 0, 1) {
+			log.Printf("No synced upstream at height %v, refusing to serve work", best)
+		}
+		return
+	}
+	if atomic.CompareAndSwapInt32(&s.lagging, 1, 0) {
+		log.Printf("Upstream %v is synced, serving work again", s.upstreams[preferred].Name)
 	}
 
-	if s.upstream != candidate {
-		log.Printf("Switching to %v upstream", s.upstreams[candidate].Name)
-		atomic.StoreInt32(&s.upstream, candidate)
+	if preferred == current {
+		s.preferredChecks = 0
+		return
+	}
+	if eligible(current) {
+		if preferred != s.preferred {
+			s.preferred = preferred
+			s.preferredChecks = 0
+		}
+		s.preferredChecks++
+		if s.preferredChecks < s.config.UpstreamSwitchChecks {
+			return
+		}
+	}
+	s.preferredChecks = 0
+	log.Printf("Switching to %v upstream", s.upstreams[preferred].Name)
+	atomic.StoreInt32(&s.upstream, int32(preferred))
+}
+
+// Higher chain wins, then lower latency, ties keep configured order
+func betterUpstream(a, b rpc.NodeStatus) bool {
+	if a.FullHeight != b.FullHeight {
+		return a.FullHeight > b.FullHeight
+	}
+	return a.Latency < b.Latency/2
+}
+
+func (s *ProxyServer) upstreamStates() map[string]map[string]interface{} {
+	s.upstreamsMu.RLock()
+	defer s.upstreamsMu.RUnlock()
+	current := atomic.LoadInt32(&s.upstream)
+	best := atomic.LoadInt64(&s.bestHeight)
+	states := make(map[string]map[string]interface{})
+	for i, v := range s.upstreams {
+		status := v.Status()
+		states[v.Name] = map[string]interface{}{
+			"height":        status.FullHeight,
+			"headersHeight": status.HeadersHeight,
+			"peers":         status.Peers,
+			"latency":       int64(status.Latency / time.Millisecond),
+			"synced":        status.Synced(s.maxLag),
+			"lag":           best - status.FullHeight,
+			"sick":          v.Sick(),
+			"active":        int32(i) == current,
+			"lastBeat":      status.UpdatedAt / 1000,
+		}
 	}
+	return states
 }
 
 func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -171,9 +430,18 @@ func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//	return
 	//}
 	ip := s.remoteAddr(r)
-	if !s.policy.IsBanned(ip) {
-		s.handleClient(w, r, ip)
+	if s.policy.IsBanned(ip) {
+		return
+	}
+	// Only submissions are charged, valid shares restore limit, so polling for work never runs out
+	if r.Method == "POST" && !s.policy.ApplyLimitPolicy(ip) {
+		atomic.AddInt64(&s.limitedCount, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(&ErrorReply{Code: -1, Message: "Connection limit reached"})
+		return
 	}
+	s.handleClient(w, r, ip)
 }
 
 func (s *ProxyServer) remoteAddr(r *http.Request) string {
@@ -197,8 +465,10 @@ func (s *ProxyServer) handleClient(w http.ResponseWriter, r *http.Request, ip st
 	r.Body = http.MaxBytesReader(w, r.Body, s.config.Proxy.LimitBodySize)
 	defer r.Body.Close()
 
-	cs := &Session{ip: ip, enc: json.NewEncoder(w)}
+	cs := &Session{ip: ip, enc: json.NewEncoder(w), solo: strings.HasPrefix(r.URL.Path, "/solo/")}
 	dec := json.NewDecoder(r.Body)
+	// Keep d exact, it does not fit into float64
+	dec.UseNumber()
 	for {
 		var req map[string]interface{}
 		if err := dec.Decode(&req); err == io.EOF {
@@ -221,18 +491,23 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req map[string
 	// }
 
 	vars := mux.Vars(r)
-	login := vars["login"]
+	login, diffHint := splitLogin(vars["login"])
+	if len(vars["diff"]) > 0 {
+		diffHint = vars["diff"]
+	}
+	cs.diff = s.shareDifficulty(diffHint)
 
-	// if !util.IsValidHexAddress(login) {
-	// 	errReply := &ErrorReply{Code: -1, Message: "Invalid login"}
-	// 	cs.sendError(req.Id, errReply)
-	// 	return
-	// }
-	// if !s.policy.ApplyLoginPolicy(login, cs.ip) {
-	// 	errReply := &ErrorReply{Code: -1, Message: "You are blacklisted"}
-	// 	cs.sendError(req.Id, errReply)
-	// 	return
-	// }
+	if !s.network.IsValidAddress(login) {
+		errReply := &ErrorReply{Code: -1, Message: "Invalid login"}
+		cs.sendError(errReply)
+		return
+	}
+	if !s.policy.ApplyLoginPolicy(login, cs.ip) {
+		atomic.AddInt64(&s.blacklistedCount, 1)
+		errReply := &ErrorReply{Code: -1, Message: "You are blacklisted"}
+		cs.sendError(errReply)
+		return
+	}
 
 	//if r.Method != "POST" {
 	//	s.writeError(w, 405, "rpc: POST method required, received "+r.Method)
@@ -241,6 +516,13 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req map[string
 	// Handle RPC methods
 	switch r.Method {
 	case "GET":
+		lastMsg := r.URL.Query().Get("lastMsg")
+		if len(lastMsg) == 0 {
+			lastMsg = r.Header.Get("X-Last-Msg")
+		}
+		if len(lastMsg) > 0 {
+			s.waitForNewWork(r.Context(), lastMsg)
+		}
 		reply, errReply := s.handleGetWorkRPC(cs)
 		if errReply != nil {
 			cs.sendError(errReply)
@@ -249,21 +531,20 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req map[string
 		cs.sendResult(reply)
 
 	case "POST":
-		log.Println("Get Sol: ", req)
-		hashFloat, okD := req["d"].(float64)
-		hash := big.NewFloat(hashFloat) //.Int(nil)
-
-		pkHex, okPK := req["pk"].(string)
-		wHex, okW := req["w"].(string)
+		// Autolykos v2 solution has only nonce, v1 also carries pk, w and d
 		nHex, okN := req["n"].(string)
+		pkHex, _ := req["pk"].(string)
+		wHex, _ := req["w"].(string)
+		d, okD := parseBigInt(req["d"])
+		_, hasD := req["d"]
 
-		if hash != nil && okD && okN && okPK && okW {
+		if okN && (okD || !hasD) {
 
 			var params = &rpc.SolutionReq{
-				PK:   pkHex,
-				W:    wHex,
-				N:    nHex,
-				Hash: hash, // d
+				PK: pkHex,
+				W:  wHex,
+				N:  nHex,
+				D:  d,
 			}
 			// err := json.Unmarshal(req.Params, &params)
 			// if err != nil {
@@ -278,12 +559,13 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req map[string
 				break
 			}
 			if !reply {
-				cs.sendResult(map[string]string{
+				cs.sendResult(map[string]interface{}{
 					"error": "Solution is invalid",
 				})
+				break
 			}
 
-			cs.sendResult(map[string]string{
+			cs.sendResult(map[string]interface{}{
 				"success": "Solution is valid",
 			})
 
@@ -304,7 +586,21 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req map[string
 	}
 }
 
-func (cs *Session) sendResult(result map[string]string) error {
+// Accepts JSON number or decimal string
+func parseBigInt(v interface{}) (*big.Int, bool) {
+	var s string
+	switch x := v.(type) {
+	case json.Number:
+		s = x.String()
+	case string:
+		s = x
+	default:
+		return nil, false
+	}
+	return new(big.Int).SetString(s, 10)
+}
+
+func (cs *Session) sendResult(result map[string]interface{}) error {
 	//message := JSONRpcResp{Id: id, Version: "2.0", Error: nil, Result: result}
 	// log.Println("sending result:", &result)
 	return cs.enc.Encode(&result)
@@ -334,6 +630,9 @@ func (s *ProxyServer) markSick() {
 }
 
 func (s *ProxyServer) isSick() bool {
+	if atomic.LoadInt32(&s.lagging) == 1 {
+		return true
+	}
 	x := atomic.LoadInt64(&s.failsCount)
 	if s.config.Proxy.HealthCheck && x >= s.config.Proxy.MaxFails {
 		return true
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maoxs2/ergoPool/ergo"
+	"github.com/maoxs2/ergoPool/policy"
+	"github.com/maoxs2/ergoPool/rpc"
+	"github.com/maoxs2/ergoPool/storage"
+)
+
+const testLogin = "9fRWULXtir5FyBkdU4Z9Ux5RDKXDpbKaTyk7ihSXQg4TmqkW8vE"
+
+// Proxy without upstreams, work is never ready. Policy state can't be loaded from
+// unreachable backend, it only logs that and starts with empty lists.
+func newTestProxy(t *testing.T, limit int32) *ProxyServer {
+	cfg := &Config{Name: "test"}
+	cfg.Proxy.Difficulty = 1000
+	cfg.Proxy.LimitBodySize = 1024
+	cfg.Proxy.Policy = policy.Config{
+		Workers:         1,
+		Banning:         policy.Banning{MalformedLimit: 1000},
+		Limits:          policy.Limits{Enabled: true, Limit: limit, Grace: "1ms", LimitJump: 10},
+		ResetInterval:   "1h",
+		RefreshInterval: "1h",
+	}
+	backend := storage.NewRedisClient(&storage.Config{Endpoint: "127.0.0.1:1", PoolSize: 1}, "test")
+
+	s := &ProxyServer{config: cfg, network: ergo.Mainnet, backend: backend}
+	s.policy = policy.Start(&cfg.Proxy.Policy, cfg.Name, backend)
+	limits, err := newDifficultyLimits(&cfg.Proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.difficultyLimits.Store(limits)
+	s.templateCh = make(chan struct{})
+	s.quit = make(chan struct{})
+	// Wait out limits grace period
+	time.Sleep(5 * time.Millisecond)
+	return s
+}
+
+func TestPollingIsNotLimited(t *testing.T) {
+	const limit = 5
+	s := newTestProxy(t, limit)
+	defer s.policy.Stop()
+	handler := s.newServer().Handler
+
+	for i := 0; i < 4*limit; i++ {
+		req := httptest.NewRequest("GET", "/"+testLogin+"/rig1/mining/candidate", nil)
+		req.RemoteAddr = "192.0.2.1:4000"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code == http.StatusTooManyRequests {
+			t.Fatalf("candidate request %v was limited", i+1)
+		}
+	}
+
+	// Submissions are still charged
+	limited := 0
+	for i := 0; i < 2*limit; i++ {
+		req := httptest.NewRequest("POST", "/"+testLogin+"/rig1/mining/solution", strings.NewReader("{}"))
+		req.RemoteAddr = "192.0.2.1:4000"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code == http.StatusTooManyRequests {
+			limited++
+		}
+	}
+	if limited == 0 {
+		t.Errorf("none of %v submissions over limit %v was limited", 2*limit, limit)
+	}
+	if limited == 2*limit {
+		t.Error("all submissions were limited")
+	}
+}
+
+func TestRaisedDifficultyShareIsCredited(t *testing.T) {
+	s := newTestProxy(t, 1000)
+	defer s.policy.Stop()
+	s.config.Proxy.Difficulty = 1
+	s.config.Proxy.MaxDifficulty = 8
+	limits, err := newDifficultyLimits(&s.config.Proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.difficultyLimits.Store(limits)
+
+	diff := s.shareDifficulty("8")
+	if diff != 8 {
+		t.Fatalf("share difficulty %v, want 8", diff)
+	}
+
+	const height = 614400
+	msg := strings.Repeat("5a", 32)
+	tpl := &BlockTemplate{Header: msg, headers: map[string]heightDiffPair{
+		msg: {diff: big.NewInt(0), difficulty: big.NewInt(1), height: height},
+	}}
+	// Find v2 nonce meeting raised target, and one meeting only pool target
+	target := shareTarget(diff)
+	var good, weak string
+	for i := uint64(0); len(good) == 0 || len(weak) == 0; i++ {
+		nonce := make([]byte, 8)
+		binary.BigEndian.PutUint64(nonce, i)
+		hit, err := ergo.Hit(bytes.Repeat([]byte{0x5a}, 32), nonce, height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hit.Cmp(target) < 0 {
+			good = hex.EncodeToString(nonce)
+		} else {
+			weak = hex.EncodeToString(nonce)
+		}
+	}
+
+	_, valid, errReply := s.processShare(testLogin, "rig1", "192.0.2.1", false, diff, tpl, &rpc.SolutionReq{N: good})
+	if !valid || errReply != nil {
+		t.Errorf("share at raised difficulty was not credited: %v", errReply)
+	}
+	_, valid, _ = s.processShare(testLogin, "rig1", "192.0.2.1", false, diff, tpl, &rpc.SolutionReq{N: weak})
+	if valid {
+		t.Error("share above raised target was credited")
+	}
+}
+
+func TestBlockIsRecordedOnFirstAcceptance(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+	defer close(release)
+
+	s := &ProxyServer{upstreams: []*rpc.RPCClient{
+		rpc.NewRPCClient("slow", slow.URL, "", "10s"),
+		rpc.NewRPCClient("fast", fast.URL, "", "10s"),
+	}}
+	done := make(chan []string)
+	go func() {
+		nodes, status := s.broadcastSolution(100, &rpc.SolutionReq{N: "00"})
+		if status != rpc.SubmitAccepted {
+			t.Errorf("submission status %v, want accepted", status)
+		}
+		done <- nodes
+	}()
+	select {
+	case nodes := <-done:
+		if len(nodes) != 1 || nodes[0] != "fast" {
+			t.Errorf("accepted by %v, want fast", nodes)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("block submission waits for slow node")
+	}
+}
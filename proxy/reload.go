@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/maoxs2/ergoPool/rpc"
+)
+
+// Reload applies upstream list, share difficulty and policy of reloaded config.
+// Nothing is applied if any of them is invalid.
+func (s *ProxyServer) Reload(cfg *Config) error {
+	limits, err := newDifficultyLimits(&cfg.Proxy)
+	if err != nil {
+		return fmt.Errorf("invalid share difficulty: %v", err)
+	}
+	upstreams, err := s.reloadedUpstreams(cfg.Upstream)
+	if err != nil {
+		return err
+	}
+	err = s.policy.Reload(&cfg.Proxy.Policy)
+	if err != nil {
+		return fmt.Errorf("invalid policy: %v", err)
+	}
+
+	s.upstreamsMu.Lock()
+	current := s.upstreams[atomic.LoadInt32(&s.upstream)]
+	next := 0
+	for i, v := range upstreams {
+		if v == current {
+			next = i
+		}
+	}
+	s.upstreams = upstreams
+	s.upstreamCfgs = cfg.Upstream
+	s.preferred = 0
+	s.preferredChecks = 0
+	atomic.StoreInt32(&s.upstream, int32(next))
+	s.upstreamsMu.Unlock()
+	if upstreams[next] != current {
+		log.Printf("Upstream %v was removed, switching to %v", current.Name, upstreams[next].Name)
+	}
+
+	s.difficultyLimits.Store(limits)
+	log.Printf("Proxy reloaded: %v upstreams, share difficulty %v", len(upstreams), limits.diff)
+	return nil
+}
+
+// Config version of proxy instance is shown with its node state
+func (s *ProxyServer) PublishConfigVersion(version string) {
+	err := s.backend.WriteNodeConfigVersion(s.config.Name, version)
+	if err != nil {
+		log.Printf("Failed to write config version to backend: %v", err)
+	}
+}
+
+// Unchanged upstreams keep their clients, so health state survives reload
+func (s *ProxyServer) reloadedUpstreams(cfgs []Upstream) ([]*rpc.RPCClient, error) {
+	if len(cfgs) == 0 {
+		return nil, errors.New("upstream list is empty")
+	}
+	s.upstreamsMu.RLock()
+	existing := make(map[Upstream]*rpc.RPCClient, len(s.upstreams))
+	for i, v := range s.upstreamCfgs {
+		existing[v] = s.upstreams[i]
+	}
+	s.upstreamsMu.RUnlock()
+
+	names := make(map[string]bool, len(cfgs))
+	upstreams := make([]*rpc.RPCClient, len(cfgs))
+	for i, v := range cfgs {
+		if names[v.Name] {
+			return nil, fmt.Errorf("duplicate upstream name %s", v.Name)
+		}
+		names[v.Name] = true
+		if r, ok := existing[v]; ok {
+			upstreams[i] = r
+			continue
+		}
+		r, err := s.newUpstream(v)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Upstream: %s => %s", v.Name, v.Url)
+		upstreams[i] = r
+	}
+	return upstreams, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"reflect"
+	"strings"
+
+	"github.com/maoxs2/ergoPool/proxy"
+)
+
+// Config fields applied to running modules on SIGHUP as JSON paths, nested fields included.
+// Any other change needs restart and is ignored on reload.
+var reloadableFields = []string{
+	"upstream",
+	"proxy.difficulty",
+	"proxy.minDifficulty",
+	"proxy.maxDifficulty",
+	"proxy.policy.limits",
+	"proxy.policy.banning.timeout",
+	"proxy.policy.banning.invalidPercent",
+	"proxy.policy.banning.checkThreshold",
+	"proxy.policy.banning.malformedLimit",
+	"proxy.policy.banning.escalationFactor",
+	"proxy.policy.banning.maxTimeout",
+	"proxy.policy.banning.offenseWindow",
+	"payouts.threshold",
+	"payouts.interval",
+	"api.hashrateWindow",
+	"api.hashrateLargeWindow",
+	"api.luckWindow",
+}
+
+// Config as loaded from file and applied to modules, modules may adjust their own copy on start
+var activeConfig proxy.Config
+
+func isReloadable(path string) bool {
+	for _, v := range reloadableFields {
+		if path == v || strings.HasPrefix(path, v+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Reverts fields which need restart to running values and returns JSON paths of reverted ones
+func keepRestartOnly(running, loaded reflect.Value, path string) []string {
+	var changed []string
+	t := running.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if len(field.PkgPath) > 0 {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if len(name) == 0 {
+			name = field.Name
+		}
+		if len(path) > 0 {
+			name = path + "." + name
+		}
+		if isReloadable(name) {
+			continue
+		}
+		if field.Type.Kind() == reflect.Struct {
+			changed = append(changed, keepRestartOnly(running.Field(i), loaded.Field(i), name)...)
+			continue
+		}
+		if !reflect.DeepEqual(running.Field(i).Interface(), loaded.Field(i).Interface()) {
+			changed = append(changed, name)
+			loaded.Field(i).Set(running.Field(i))
+		}
+	}
+	return changed
+}
+
+// Short hash of effective config, shown in API to tell which config instance runs
+func configVersion(cfg *proxy.Config) string {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:6])
+}
+
+func publishConfigVersion(version string) {
+	if proxyServer != nil {
+		proxyServer.PublishConfigVersion(version)
+	}
+	if apiServer != nil {
+		apiServer.SetConfigVersion(version)
+	}
+}
+
+func reloadConfig(configFileName string) {
+	var loaded proxy.Config
+	if err := loadConfig(&loaded, configFileName); err != nil {
+		log.Printf("Config reload failed: %v", err)
+		return
+	}
+	for _, name := range keepRestartOnly(reflect.ValueOf(&activeConfig).Elem(), reflect.ValueOf(&loaded).Elem(), "") {
+		log.Printf("Config reload: %s can't be changed at runtime, restart to apply it", name)
+	}
+	if problems := validateConfig(&loaded); len(problems) > 0 {
+		for _, problem := range problems {
+			log.Println(problem)
+		}
+		log.Printf("Config reload rejected, config has %v problems", len(problems))
+		return
+	}
+
+	// Proxy goes first, rejected upstreams or difficulty reject the whole reload
+	if proxyServer != nil {
+		if err := proxyServer.Reload(&loaded); err != nil {
+			log.Printf("Config reload rejected: %v", err)
+			return
+		}
+	} else {
+		loaded.Upstream = activeConfig.Upstream
+		loaded.Proxy = activeConfig.Proxy
+	}
+	if apiServer != nil {
+		if err := apiServer.Reload(&loaded.Api); err != nil {
+			log.Printf("Config reload of API rejected: %v", err)
+			loaded.Api = activeConfig.Api
+		}
+	} else {
+		loaded.Api = activeConfig.Api
+	}
+	if payoutsProcessor != nil {
+		if err := payoutsProcessor.Reload(&loaded.Payouts); err != nil {
+			log.Printf("Config reload of payouts rejected: %v", err)
+			loaded.Payouts = activeConfig.Payouts
+		}
+	} else {
+		loaded.Payouts = activeConfig.Payouts
+	}
+
+	version := configVersion(&loaded)
+	if version == configVersion(&activeConfig) {
+		log.Println("Config reloaded, nothing changed")
+		return
+	}
+	activeConfig = loaded
+	publishConfigVersion(version)
+	log.Printf("Config reloaded, version %s", version)
+}
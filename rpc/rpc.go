@@ -2,41 +2,113 @@ package rpc
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"math/big"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
-
-	"github.com/ethereum/go-ethereum/common"
+	"time"
 
 	"github.com/maoxs2/ergoPool/util"
 )
 
+// Idempotent requests are retried on network and server errors
+const (
+	maxRetries   = 2
+	retryBackoff = 250 * time.Millisecond
+)
+
+var ErrEmptyReply = errors.New("empty reply from node")
+
+// NodeError is an error reply of node REST API
+type NodeError struct {
+	StatusCode int    `json:"error"`
+	Reason     string `json:"reason"`
+	Detail     string `json:"detail"`
+}
+
+func (e *NodeError) Error() string {
+	if len(e.Detail) > 0 {
+		return fmt.Sprintf("node replied %v %s: %s", e.StatusCode, e.Reason, e.Detail)
+	}
+	return fmt.Sprintf("node replied %v %s", e.StatusCode, e.Reason)
+}
+
+func (e *NodeError) Temporary() bool {
+	return e.StatusCode >= 500
+}
+
+// NetworkError is returned for node which is on another network or doesn't tell its network
+type NetworkError struct {
+	Node     string
+	Network  string
+	Expected string
+}
+
+func (e *NetworkError) Error() string {
+	if len(e.Network) == 0 {
+		return fmt.Sprintf("node %s does not report its network, pool is configured for %s", e.Node, e.Expected)
+	}
+	return fmt.Sprintf("node %s is on %s, pool is configured for %s", e.Node, e.Network, e.Expected)
+}
+
+func IsNetworkMismatch(err error) bool {
+	_, ok := err.(*NetworkError)
+	return ok
+}
+
+func IsNotFound(err error) bool {
+	e, ok := err.(*NodeError)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
 type RPCClient struct {
 	sync.RWMutex
 	Url         string
 	Name        string
+	apiKey      string
 	sick        bool
 	sickRate    int
 	successRate int
+	status      NodeStatus
+	miningPK    string
+	network     string
+	networkOk   bool
 	client      *http.Client
 }
 
-type GetBlockReply struct {
-	Number     string `json:"number"`
-	Hash       string `json:"hash"`
-	Nonce      string `json:"nonce"`
-	Miner      string `json:"miner"`
-	Difficulty string `json:"difficulty"`
+// Node state as of last health check
+type NodeStatus struct {
+	FullHeight    int64
+	HeadersHeight int64
+	Peers         int64
+	Latency       time.Duration
+	UpdatedAt     int64
+}
+
+// Node is synced when it has validated full blocks close to best header it knows
+func (s NodeStatus) Synced(maxGap int64) bool {
+	return s.FullHeight > 0 && s.HeadersHeight-s.FullHeight <= maxGap
+}
 
-	Transactions []Tx `json:"transactions"`
-	// https://github.com/ethereum/EIPs/issues/95
-	SealFields []string `json:"sealFields"`
+type NodeInfo struct {
+	Name          string   `json:"name"`
+	AppVersion    string   `json:"appVersion"`
+	Network       string   `json:"network"`
+	FullHeight    int64    `json:"fullHeight"`
+	HeadersHeight int64    `json:"headersHeight"`
+	BestHeaderId  string   `json:"bestHeaderId"`
+	PeersCount    int64    `json:"peersCount"`
+	Difficulty    *big.Int `json:"difficulty"`
+	IsMining      bool     `json:"isMining"`
 }
 
 type GetBlockReplyPart struct {
@@ -44,54 +116,61 @@ type GetBlockReplyPart struct {
 	Target string `json:"difficulty"`
 }
 
-const receiptStatusSuccessful = "0x1"
-
-type TxReceipt struct {
-	TxHash    string `json:"transactionHash"`
-	GasUsed   string `json:"gasUsed"`
-	BlockHash string `json:"blockHash"`
-	Status    string `json:"status"`
-}
-
-func (r *TxReceipt) Confirmed() bool {
-	return len(r.BlockHash) > 0
+// Mining candidate, fields unknown to pool are kept in Extra and passed to miners as is
+type CandidateResp struct {
+	Msg    string                     `json:"msg"`
+	Target *big.Int                   `json:"b"`
+	Height uint64                     `json:"h,omitempty"`
+	PK     string                     `json:"pk"`
+	Proof  json.RawMessage            `json:"proof,omitempty"`
+	Extra  map[string]json.RawMessage `json:"-"`
 }
 
-// Use with previous method
-func (r *TxReceipt) Successful() bool {
-	if len(r.Status) > 0 {
-		return r.Status == receiptStatusSuccessful
+func (c *CandidateResp) UnmarshalJSON(data []byte) error {
+	type candidate CandidateResp
+	if err := json.Unmarshal(data, (*candidate)(c)); err != nil {
+		return err
 	}
-	return true
-}
-
-type Tx struct {
-	Gas      string `json:"gas"`
-	GasPrice string `json:"gasPrice"`
-	Hash     string `json:"hash"`
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for _, k := range []string{"msg", "b", "h", "pk", "proof"} {
+		delete(fields, k)
+	}
+	if len(fields) > 0 {
+		c.Extra = fields
+	}
+	return nil
 }
 
-type JSONRpcResp struct {
-	Id     *json.RawMessage       `json:"id"`
-	Result *json.RawMessage       `json:"result"`
-	Error  map[string]interface{} `json:"error"`
+// Autolykos v2 solution carries only nonce, other fields are omitted then
+type SolutionReq struct {
+	PK string   `json:"pk,omitempty"`
+	W  string   `json:"w,omitempty"`
+	N  string   `json:"n"`
+	D  *big.Int `json:"d,omitempty"`
 }
 
-type CandidateResp struct {
-	Msg    string   `json:"msg"`
-	Target *big.Int `json:"b"`
-	PK     string   `json:"pk"`
+type BlockHeader struct {
+	Id         string   `json:"id"`
+	ParentId   string   `json:"parentId"`
+	Height     int64    `json:"height"`
+	Timestamp  int64    `json:"timestamp"`
+	PoWSol     PoWSol   `json:"powSolutions"`
+	Difficulty *big.Int `json:"difficulty"`
 }
 
-type SolutionReq struct {
-	PK   string     `json:"pk"`
-	W    string     `json:"w"`
-	N    string     `json:"n"`
-	Hash *big.Float `json:"d"`
+type PoWSol struct {
+	PublicKey string      `json:"pk"`
+	W         string      `json:"w"`
+	N         string      `json:"n"`
+	D         json.Number `json:"d"`
 }
 
-func NewRPCClient(name, url, timeout string) *RPCClient {
-	rpcClient := &RPCClient{Name: name, Url: url}
+// apiKey is sent only to protected routes and can be empty for public node API
+func NewRPCClient(name, url, apiKey, timeout string) *RPCClient {
+	rpcClient := &RPCClient{Name: name, Url: strings.TrimSuffix(url, "/"), apiKey: apiKey}
 	timeoutIntv := util.MustParseDuration(timeout)
 	rpcClient.client = &http.Client{
 		Timeout: timeoutIntv,
@@ -99,319 +178,295 @@ func NewRPCClient(name, url, timeout string) *RPCClient {
 	return rpcClient
 }
 
-func (r *RPCClient) GetWork() (*CandidateResp, error) {
-	req, err := http.NewRequest("GET", r.Url+"/mining/candidate", bytes.NewBuffer(nil))
-	req.Header.Set("Accept", "application/json")
-
-	resp, err := r.client.Do(req)
-	if err != nil {
-		r.markSick()
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	var rpcResp *CandidateResp
-	err = json.NewDecoder(resp.Body).Decode(&rpcResp)
+func (r *RPCClient) GetInfo(ctx context.Context) (*NodeInfo, error) {
+	var reply NodeInfo
+	err := r.doGet(ctx, "/info", false, &reply)
 	if err != nil {
-		r.markSick()
 		return nil, err
 	}
-
-	return rpcResp, err
-}
-
-func (r *RPCClient) GetInfo() map[string]interface{} {
-	//var reply map[string]string
-	rpcResp, _ := r.doGet("/info")
-	//if err != nil {
-	//	return rpcResp
-	//}
-	//var reply []string
-	//err = json.Unmarshal(*rpcResp, &reply)
-
-	return rpcResp
+	return &reply, nil
 }
 
-// TODO: in unlocker
-// = get current block/height
-func (r *RPCClient) GetPendingBlock() (*BlockHeader, error) {
-	req, err := http.NewRequest("GET", r.Url+"/blocks/lastHeaders/1", bytes.NewBuffer(nil))
-	req.Header.Set("Accept", "application/json")
-
-	resp, err := r.client.Do(req)
+func (r *RPCClient) GetWork(ctx context.Context) (*CandidateResp, error) {
+	var reply CandidateResp
+	err := r.doGet(ctx, "/mining/candidate", false, &reply)
 	if err != nil {
-		r.markSick()
 		return nil, err
 	}
-	defer resp.Body.Close()
-
-	var blockResp []BlockHeader
-	err = json.NewDecoder(resp.Body).Decode(&blockResp)
-	if err != nil {
-		r.markSick()
-		return nil, err
+	if len(reply.Msg) == 0 || reply.Target == nil {
+		return nil, ErrEmptyReply
 	}
-
-	return &blockResp[0], nil
-}
-
-type BlockHeader struct {
-	Number string `json:"height"`
-	Hash   string `json:"id"`
-	PoWSol PoWSol `json:"powSolutions"`
+	return &reply, nil
 }
 
-type PoWSol struct {
-	PublicKey string `json:"pk"`
-	W         string `json:"w"`
-	N         string `json:"n"`
-	D         string `json:"d"`
+// Ids of all known blocks at height, best chain block goes first
+func (r *RPCClient) GetBlockIdsAt(ctx context.Context, height int64) ([]string, error) {
+	var reply []string
+	err := r.doGet(ctx, "/blocks/at/"+strconv.FormatInt(height, 10), false, &reply)
+	return reply, err
 }
 
-// DONE: in unlocker
-func (r *RPCClient) GetBlockByHeight(height int64) (*BlockHeader, error) {
-	h := strconv.FormatInt(height, 10)
-	req, err := http.NewRequest("GET", r.Url+"/blocks/at/"+h, bytes.NewBuffer(nil))
-	req.Header.Set("Accept", "application/json")
-
-	resp, err := r.client.Do(req)
+func (r *RPCClient) GetBlockHeader(ctx context.Context, id string) (*BlockHeader, error) {
+	var reply BlockHeader
+	err := r.doGet(ctx, "/blocks/"+id+"/header", false, &reply)
 	if err != nil {
-		r.markSick()
 		return nil, err
 	}
-	defer resp.Body.Close()
+	return &reply, nil
+}
 
-	var blockResp []string
-	err = json.NewDecoder(resp.Body).Decode(&blockResp)
+// Returns nil header if node has no block at height yet
+func (r *RPCClient) GetBlockByHeight(ctx context.Context, height int64) (*BlockHeader, error) {
+	ids, err := r.GetBlockIdsAt(ctx, height)
 	if err != nil {
-		r.markSick()
 		return nil, err
 	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return r.GetBlockHeader(ctx, ids[0])
+}
 
-	blockHeader := blockResp[0]
-
-	req, err = http.NewRequest("GET", r.Url+"/blocks/"+blockHeader+"/header", bytes.NewBuffer(nil))
-	req.Header.Set("Accept", "application/json")
+type SubmitStatus int
 
-	resp, err = r.client.Do(req)
-	if err != nil {
-		r.markSick()
-		return nil, err
-	}
-	defer resp.Body.Close()
+const (
+	SubmitAccepted SubmitStatus = iota
+	SubmitInvalid
+	SubmitStale
+	SubmitNodeError
+)
 
-	var rpcResp *BlockHeader
-	err = json.NewDecoder(resp.Body).Decode(&rpcResp)
-	if err != nil {
-		r.markSick()
-		return nil, err
+func (s SubmitStatus) String() string {
+	switch s {
+	case SubmitAccepted:
+		return "accepted"
+	case SubmitInvalid:
+		return "invalid"
+	case SubmitStale:
+		return "stale"
 	}
+	return "node error"
+}
 
-	return rpcResp, err
+type SubmitResult struct {
+	Status SubmitStatus
+	Detail string
 }
 
-//func (r *RPCClient) GetBlockByHash(hash string) (*GetBlockReply, error) {
-//	params := []interface{}{hash, true}
-//	return r.getBlockBy("vns_getBlockByHash", params)
-//}
+// Node rejects solution for outdated candidate with the same 400 reply as invalid one, only detail differs
+var stalePattern = regexp.MustCompile(`(?i)stale|outdated|obsolete|not found|doesn't exist|does not exist|unknown candidate`)
 
-// TODO: in payer
-func (r *RPCClient) GetTxReceipt(hash string) (*TxReceipt, error) {
-	rpcResp, err := r.doPost(r.Url, "vns_getTransactionReceipt", []string{hash})
-	if err != nil {
-		return nil, err
+// Error is returned only for node errors, rejected solution is a normal result
+func (r *RPCClient) SubmitSolution(ctx context.Context, params *SolutionReq) (*SubmitResult, error) {
+	err := r.doPost(ctx, "/mining/solution", false, params, nil)
+	if err == nil {
+		return &SubmitResult{Status: SubmitAccepted}, nil
 	}
-	if rpcResp.Result != nil {
-		var reply *TxReceipt
-		err = json.Unmarshal(*rpcResp.Result, &reply)
-		return reply, err
+	if e, ok := err.(*NodeError); ok && e.StatusCode == http.StatusBadRequest {
+		detail := e.Detail
+		if len(detail) == 0 {
+			detail = e.Reason
+		}
+		if stalePattern.MatchString(detail) {
+			return &SubmitResult{Status: SubmitStale, Detail: detail}, nil
+		}
+		return &SubmitResult{Status: SubmitInvalid, Detail: detail}, nil
 	}
-	return nil, nil
+	return &SubmitResult{Status: SubmitNodeError, Detail: err.Error()}, err
 }
 
-func (r *RPCClient) SubmitSolution(params *SolutionReq) (bool, error) {
-	_, err := r.doPost(r.Url, "/mining/solution", params)
-	if err != nil {
-		return false, err
+// Node is sick until it reports this network, see VerifyNetwork
+func (r *RPCClient) SetNetwork(network string) {
+	r.Lock()
+	r.network = network
+	r.networkOk = false
+	r.Unlock()
+}
+
+// CheckNetwork sets expected network and checks it at once. Only NetworkError is returned,
+// unreachable node stays unchecked and is checked again before it is used.
+func (r *RPCClient) CheckNetwork(network string) error {
+	r.SetNetwork(network)
+	err := r.VerifyNetwork()
+	if err != nil && !IsNetworkMismatch(err) {
+		log.Printf("Unable to check network of node %s, it is not used until checked: %v", r.Name, err)
+		return nil
 	}
-	//var reply bool
-	//err = json.Unmarshal(*rpcResp.Result, &reply)
-	return true, err
+	return err
 }
 
-// TODO: payer
-func (r *RPCClient) GetBalance(address string) (*big.Int, error) {
-	rpcResp, err := r.doPost(r.Url, "vns_getBalance", []string{address, "latest"})
-	if err != nil {
-		return nil, err
+// VerifyNetwork compares network reported by node /info with expected one, once it matched node is not queried again
+func (r *RPCClient) VerifyNetwork() error {
+	r.RLock()
+	network, ok := r.network, r.networkOk
+	r.RUnlock()
+	if ok || len(network) == 0 {
+		return nil
 	}
-	var reply string
-	err = json.Unmarshal(*rpcResp.Result, &reply)
+	info, err := r.GetInfo(context.Background())
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("unable to check network of node %s: %v", r.Name, err)
 	}
-	return util.String2Big(reply), err
+	if !strings.EqualFold(info.Network, network) {
+		return &NetworkError{Node: r.Name, Network: info.Network, Expected: network}
+	}
+	r.Lock()
+	r.networkOk = true
+	r.Unlock()
+	return nil
 }
 
-// TODO: in payer
-func (r *RPCClient) Sign(from string, s string) (string, error) {
-	hash := sha256.Sum256([]byte(s))
-	rpcResp, err := r.doPost(r.Url, "vns_sign", []string{from, common.ToHex(hash[:])})
-	var reply string
-	if err != nil {
-		return reply, err
+func (r *RPCClient) doGet(ctx context.Context, path string, protected bool, reply interface{}) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = r.do(ctx, "GET", path, protected, nil, reply)
+		if !retryable(err) || attempt >= maxRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryBackoff << uint(attempt)):
+		}
 	}
-	err = json.Unmarshal(*rpcResp.Result, &reply)
+}
+
+// Not retried, node could have applied request before it failed
+func (r *RPCClient) doPost(ctx context.Context, path string, protected bool, params, reply interface{}) error {
+	data, err := json.Marshal(params)
 	if err != nil {
-		return reply, err
-	}
-	if util.IsZeroHash(reply) {
-		err = errors.New("Can't sign message, perhaps account is locked")
+		return err
 	}
-	return reply, err
+	return r.do(ctx, "POST", path, protected, data, reply)
 }
 
-// TODO: in payer
-func (r *RPCClient) GetPeerCount() (int64, error) {
-	rpcResp, err := r.doPost(r.Url, "net_peerCount", nil)
-	if err != nil {
-		return 0, err
+func (r *RPCClient) do(ctx context.Context, method, path string, protected bool, data []byte, reply interface{}) error {
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewReader(data)
 	}
-	var reply string
-	err = json.Unmarshal(*rpcResp.Result, &reply)
-	if err != nil {
-		return 0, err
-	}
-	return strconv.ParseInt(strings.Replace(reply, "0x", "", -1), 16, 64)
-}
-
-// TODO: in payer
-func (r *RPCClient) SendTransaction(from, to, gas, gasPrice, value string, autoGas bool) (string, error) {
-	params := map[string]string{
-		"address":  to,
-		"value": value,
-		"fee": gasPrice,
-	}
-	//if !autoGas {
-	//	params["gas"] = gas
-	//	params["gasPrice"] = gasPrice
-	//}
-
-	// req, err := http.NewRequest("POST", r.Url+"/wallet/payment/send", bytes.NewBuffer(nil))
-	// req.Header.Set("Accept", "application/json")
-
-	// resp, err := r.client.Do(req)
-	// if err != nil {
-	// 	r.markSick()
-	// 	return nil, err
-	// }
-	// defer resp.Body.Close()
-
-	// var blockResp []string
-	// err = json.NewDecoder(resp.Body).Decode(&blockResp)
-	// if err != nil {
-	// 	r.markSick()
-	// 	return nil, err
-	// }
-
-	rpcResp, err := r.doPost(r.Url, "vns_sendTransaction", []interface{}{params})
-	var reply string
+	req, err := http.NewRequest(method, r.Url+path, body)
 	if err != nil {
-		return reply, err
+		return err
 	}
-	err = json.Unmarshal(*rpcResp.Result, &reply)
-	if err != nil {
-		return reply, err
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
 	}
-	/* There is an inconsistence in a "standard". Geth returns error if it can't unlock signer account,
-	 * but Parity returns zero hash 0x000... if it can't send tx, so we must handle this case.
-	 * https://github.com/ethereum/wiki/wiki/JSON-RPC#returns-22
-	 */
-	if util.IsZeroHash(reply) {
-		err = errors.New("transaction is not yet available")
+	if protected {
+		req.Header.Set("api_key", r.apiKey)
 	}
-	return reply, err
-}
-
-func (r *RPCClient) doPost(url string, method string, params interface{}) (*JSONRpcResp, error) {
-	//jsonReq := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params, "id": 0}
-	data, _ := json.Marshal(params)
-	log.Println(string(data))
-
-	req, err := http.NewRequest("POST", url+method, bytes.NewBuffer(data))
-	req.Header.Set("Content-Length", (string)(len(data)))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
 
 	resp, err := r.client.Do(req)
 	if err != nil {
 		r.markSick()
-		return nil, err
+		return err
 	}
 	defer resp.Body.Close()
 
-	//var rpcResp *JSONRpcResp
-	//err = json.NewDecoder(resp.Body).Decode(&rpcResp)
-	//if err != nil {
-	//	r.markSick()
-	//	return nil, err
-	//}
-	//if rpcResp.Error != nil {
-	//	r.markSick()
-	//	return nil, errors.New(rpcResp.Error["message"].(string))
-	//}
+	if resp.StatusCode != http.StatusOK {
+		nodeErr := &NodeError{}
+		json.NewDecoder(resp.Body).Decode(nodeErr)
+		nodeErr.StatusCode = resp.StatusCode
+		if len(nodeErr.Reason) == 0 {
+			nodeErr.Reason = http.StatusText(resp.StatusCode)
+		}
+		if nodeErr.Temporary() {
+			r.markSick()
+		}
+		return nodeErr
+	}
+	if reply == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(reply)
+	if err == io.EOF {
+		return ErrEmptyReply
+	}
+	if err != nil {
+		r.markSick()
+		return fmt.Errorf("malformed reply from node: %v", err)
+	}
+	return nil
+}
 
-	if resp.StatusCode != 200 {
-		var errMsgs map[string]interface{}
-		json.NewDecoder(resp.Body).Decode(&errMsgs)
-		detail, _ := errMsgs["detail"].(string)
-		log.Println(detail)
-		return nil, errors.New(string(detail))
+func retryable(err error) bool {
+	if err == nil || err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	if e, ok := err.(*NodeError); ok {
+		return e.Temporary()
 	}
+	return err != ErrEmptyReply
+}
 
-	return nil, nil
+// Candidates with another miner pk are refused and node is kept sick
+func (r *RPCClient) SetMiningPK(pk string) {
+	r.Lock()
+	r.miningPK = strings.ToLower(pk)
+	r.Unlock()
 }
 
-func (r *RPCClient) doGet(subUrl string) (map[string]interface{}, error) {
-	req, err := http.NewRequest("GET", r.Url+subUrl, bytes.NewBuffer(nil))
-	//req.Header.Set("Content-Length", (string)(len(data)))
-	//req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
+func (r *RPCClient) VerifyMiningPK(pk string) error {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.miningPK) == 0 || strings.EqualFold(pk, r.miningPK) {
+		return nil
+	}
+	r.sick = true
+	r.sickRate = 5
+	r.successRate = 0
+	return fmt.Errorf("node %s mines to pk %s instead of pool pk %s", r.Name, pk, r.miningPK)
+}
 
-	resp, err := r.client.Do(req)
-	if err != nil {
+func (r *RPCClient) Check() bool {
+	if err := r.VerifyNetwork(); err != nil {
+		if IsNetworkMismatch(err) {
+			log.Printf("ALERT: %v, refusing its work", err)
+		}
 		r.markSick()
-		return nil, err
+		return false
 	}
-	defer resp.Body.Close()
-
-	var rpcResp map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&rpcResp)
+	start := time.Now()
+	info, err := r.GetInfo(context.Background())
 	if err != nil {
-		r.markSick()
-		return nil, err
+		return false
 	}
-	//if rpcResp.Error != nil {
-	//	r.markSick()
-	//	return nil, errors.New(rpcResp.Error["message"].(string))
-	//}
-
-	return rpcResp, err
-}
+	r.Lock()
+	r.status = NodeStatus{
+		FullHeight:    info.FullHeight,
+		HeadersHeight: info.HeadersHeight,
+		Peers:         info.PeersCount,
+		Latency:       time.Since(start),
+		UpdatedAt:     util.MakeTimestamp(),
+	}
+	r.Unlock()
 
-func (r *RPCClient) Check() bool {
-	_, err := r.GetWork()
+	work, err := r.GetWork(context.Background())
 	if err != nil {
 		return false
 	}
+	if err := r.VerifyMiningPK(work.PK); err != nil {
+		log.Printf("ALERT: %v, refusing its work", err)
+		return false
+	}
 	r.markAlive()
 	return !r.Sick()
 }
 
+func (r *RPCClient) Status() NodeStatus {
+	r.RLock()
+	defer r.RUnlock()
+	return r.status
+}
+
+// Node with unchecked network is sick as well
 func (r *RPCClient) Sick() bool {
 	r.RLock()
 	defer r.RUnlock()
-	return r.sick
+	return r.sick || (len(r.network) > 0 && !r.networkOk)
 }
 
 func (r *RPCClient) markSick() {
@@ -0,0 +1,83 @@
+package rpc
+
+import (
+	"context"
+	"net/url"
+)
+
+// Wallet routes are protected and need node api key
+
+type WalletStatus struct {
+	IsInitialized bool   `json:"isInitialized"`
+	IsUnlocked    bool   `json:"isUnlocked"`
+	ChangeAddress string `json:"changeAddress"`
+	WalletHeight  int64  `json:"walletHeight"`
+	Error         string `json:"error"`
+}
+
+type WalletBalance struct {
+	Height  int64 `json:"height"`
+	Balance int64 `json:"balance"`
+}
+
+type WalletTx struct {
+	Id               string `json:"id"`
+	InclusionHeight  int64  `json:"inclusionHeight"`
+	NumConfirmations int64  `json:"numConfirmations"`
+}
+
+type PaymentRequest struct {
+	Address string `json:"address"`
+	Value   int64  `json:"value"`
+}
+
+type paymentTx struct {
+	Requests []PaymentRequest `json:"requests"`
+	Fee      int64            `json:"fee"`
+}
+
+func (r *RPCClient) GetWalletStatus(ctx context.Context) (*WalletStatus, error) {
+	var reply WalletStatus
+	err := r.doGet(ctx, "/wallet/status", true, &reply)
+	if err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+// Confirmed balance of node wallet in nanoERG
+func (r *RPCClient) GetWalletBalance(ctx context.Context) (*WalletBalance, error) {
+	var reply WalletBalance
+	err := r.doGet(ctx, "/wallet/balances", true, &reply)
+	if err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+// Builds, signs and broadcasts payment from node wallet, returns transaction id
+func (r *RPCClient) SendPayment(ctx context.Context, address string, amount, fee int64) (string, error) {
+	params := &paymentTx{
+		Requests: []PaymentRequest{{Address: address, Value: amount}},
+		Fee:      fee,
+	}
+	var txId string
+	err := r.doPost(ctx, "/wallet/transaction/send", true, params, &txId)
+	if err != nil {
+		return "", err
+	}
+	if len(txId) == 0 {
+		return "", ErrEmptyReply
+	}
+	return txId, nil
+}
+
+// Not found error means wallet doesn't know transaction yet
+func (r *RPCClient) GetWalletTransaction(ctx context.Context, id string) (*WalletTx, error) {
+	var reply WalletTx
+	err := r.doGet(ctx, "/wallet/transactionById?id="+url.QueryEscape(id), true, &reply)
+	if err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/maoxs2/ergoPool/util"
+)
+
+const backupVersion = 1
+
+// Backup is a portable dump of every key under pool prefix. Key names are stored
+// without prefix so backup may be restored under another coin name.
+type Backup struct {
+	Version   int                   `json:"version"`
+	Prefix    string                `json:"prefix"`
+	CreatedAt int64                 `json:"createdAt"`
+	Checksum  string                `json:"checksum"`
+	Keys      map[string]*BackupKey `json:"keys"`
+}
+
+type BackupKey struct {
+	Type  string            `json:"type"`
+	TTL   int64             `json:"ttl,omitempty"`
+	Value string            `json:"value,omitempty"`
+	Hash  map[string]string `json:"hash,omitempty"`
+	Set   []string          `json:"set,omitempty"`
+	ZSet  []BackupMember    `json:"zset,omitempty"`
+	List  []string          `json:"list,omitempty"`
+}
+
+type BackupMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+func (b *Backup) checksum() (string, error) {
+	// Maps are marshalled with sorted keys, so encoding is stable
+	data, err := json.Marshal(b.Keys)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (b *Backup) Verify() error {
+	if b.Version != backupVersion {
+		return fmt.Errorf("unsupported backup version %v", b.Version)
+	}
+	sum, err := b.checksum()
+	if err != nil {
+		return err
+	}
+	if sum != b.Checksum {
+		return fmt.Errorf("checksum mismatch, backup is %s, content is %s", b.Checksum, sum)
+	}
+	return nil
+}
+
+// Export dumps pool keys one by one, it is not a point in time snapshot of busy pool
+func (r *RedisClient) Export() (*Backup, error) {
+	backup := &Backup{
+		Version:   backupVersion,
+		Prefix:    r.prefix,
+		CreatedAt: util.MakeTimestamp() / 1000,
+		Keys:      make(map[string]*BackupKey),
+	}
+	keys, err := r.scanKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		value, err := r.exportKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export %s: %v", key, err)
+		}
+		// Expired meanwhile
+		if value == nil {
+			continue
+		}
+		backup.Keys[r.trimPrefix(key)] = value
+	}
+	backup.Checksum, err = backup.checksum()
+	return backup, err
+}
+
+// Restore writes backup into database without any pool keys
+func (r *RedisClient) Restore(backup *Backup) error {
+	err := backup.Verify()
+	if err != nil {
+		return err
+	}
+	keys, err := r.scanKeys()
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return fmt.Errorf("database is not empty, %v keys under %s prefix", len(keys), r.prefix)
+	}
+
+	names := make([]string, 0, len(backup.Keys))
+	for name := range backup.Keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := r.restoreKey(r.formatKey(name), backup.Keys[name])
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Diff compares backup against live data and returns human readable differences
+func (r *RedisClient) Diff(backup *Backup) ([]string, error) {
+	live, err := r.Export()
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for name, value := range backup.Keys {
+		current, ok := live.Keys[name]
+		if !ok {
+			result = append(result, fmt.Sprintf("missing in database: %s", name))
+			continue
+		}
+		if !equalKeys(value, current) {
+			result = append(result, fmt.Sprintf("differs: %s", name))
+		}
+	}
+	for name := range live.Keys {
+		if _, ok := backup.Keys[name]; !ok {
+			result = append(result, fmt.Sprintf("missing in backup: %s", name))
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func equalKeys(a, b *BackupKey) bool {
+	// TTL is ticking, compare content only
+	x, y := *a, *b
+	x.TTL, y.TTL = 0, 0
+	left, _ := json.Marshal(&x)
+	right, _ := json.Marshal(&y)
+	return string(left) == string(right)
+}
+
+func (r *RedisClient) scanKeys() ([]string, error) {
+	var c int64
+	var result []string
+	for {
+		var keys []string
+		var err error
+		c, keys, err = r.client.Scan(c, r.formatKey("*"), 1000).Result()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, keys...)
+		if c == 0 {
+			break
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (r *RedisClient) trimPrefix(key string) string {
+	return strings.TrimPrefix(key, r.prefix+":")
+}
+
+func (r *RedisClient) exportKey(key string) (*BackupKey, error) {
+	kind, err := r.client.Type(key).Result()
+	if err != nil {
+		return nil, err
+	}
+	value := &BackupKey{Type: kind}
+
+	switch kind {
+	case "none":
+		return nil, nil
+	case "string":
+		value.Value, err = r.client.Get(key).Result()
+	case "hash":
+		value.Hash, err = r.client.HGetAllMap(key).Result()
+	case "set":
+		value.Set, err = r.client.SMembers(key).Result()
+		sort.Strings(value.Set)
+	case "zset":
+		var rows []redis.Z
+		rows, err = r.client.ZRangeWithScores(key, 0, -1).Result()
+		for _, v := range rows {
+			value.ZSet = append(value.ZSet, BackupMember{Member: v.Member.(string), Score: v.Score})
+		}
+	case "list":
+		value.List, err = r.client.LRange(key, 0, -1).Result()
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ttl, err := r.client.PTTL(key).Result()
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		value.TTL = int64(ttl / time.Millisecond)
+	}
+	return value, nil
+}
+
+func (r *RedisClient) restoreKey(key string, value *BackupKey) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		switch value.Type {
+		case "string":
+			tx.Set(key, value.Value, 0)
+		case "hash":
+			tx.HMSetMap(key, value.Hash)
+		case "set":
+			tx.SAdd(key, value.Set...)
+		case "zset":
+			members := make([]redis.Z, len(value.ZSet))
+			for i, v := range value.ZSet {
+				members[i] = redis.Z{Score: v.Score, Member: v.Member}
+			}
+			tx.ZAdd(key, members...)
+		case "list":
+			tx.RPush(key, value.List...)
+		default:
+			return fmt.Errorf("unsupported key type %s", value.Type)
+		}
+		if value.TTL > 0 {
+			tx.PExpire(key, time.Duration(value.TTL)*time.Millisecond)
+		}
+		return nil
+	})
+	return err
+}
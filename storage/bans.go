@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/maoxs2/ergoPool/util"
+)
+
+// Ban is shared between proxy instances, times are in milliseconds
+type Ban struct {
+	IP        string `json:"ip"`
+	Reason    string `json:"reason"`
+	Origin    string `json:"origin"`
+	BannedAt  int64  `json:"bannedAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+	Unban     bool   `json:"unban,omitempty"`
+}
+
+// Stores ban and notifies other instances
+func (r *RedisClient) WriteBan(ban *Ban) error {
+	data, err := json.Marshal(ban)
+	if err != nil {
+		return err
+	}
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		tx.ZAdd(r.formatKey("bans"), redis.Z{Score: float64(ban.ExpiresAt), Member: ban.IP})
+		tx.HSet(r.formatKey("bans", "info"), ban.IP, string(data))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return r.client.Publish(r.formatKey("bans"), string(data)).Err()
+}
+
+func (r *RedisClient) RemoveBan(ip, origin string) error {
+	data, err := json.Marshal(&Ban{IP: ip, Origin: origin, Unban: true})
+	if err != nil {
+		return err
+	}
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		tx.ZRem(r.formatKey("bans"), ip)
+		tx.HDel(r.formatKey("bans", "info"), ip)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return r.client.Publish(r.formatKey("bans"), string(data)).Err()
+}
+
+// Drops bans which expired by now, returns number of dropped bans.
+// Ban renewed meanwhile fails the transaction, it is purged next time.
+func (r *RedisClient) PurgeExpiredBans() (int, error) {
+	now := strconv.FormatInt(util.MakeTimestamp(), 10)
+	tx, err := r.client.Watch(r.formatKey("bans"))
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+
+	expired, err := tx.ZRangeByScore(r.formatKey("bans"), redis.ZRangeByScore{Min: "-inf", Max: now}).Result()
+	if err != nil || len(expired) == 0 {
+		return 0, err
+	}
+	_, err = tx.Exec(func() error {
+		tx.ZRem(r.formatKey("bans"), expired...)
+		tx.HDel(r.formatKey("bans", "info"), expired...)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+// Returns bans which are not expired yet
+func (r *RedisClient) GetActiveBans() ([]*Ban, error) {
+	now := strconv.FormatInt(util.MakeTimestamp(), 10)
+	ips, err := r.client.ZRangeByScore(r.formatKey("bans"), redis.ZRangeByScore{Min: "(" + now, Max: "+inf"}).Result()
+	if err != nil || len(ips) == 0 {
+		return nil, err
+	}
+	rows, err := r.client.HMGet(r.formatKey("bans", "info"), ips...).Result()
+	if err != nil {
+		return nil, err
+	}
+	var result []*Ban
+	for i, row := range rows {
+		ban := &Ban{IP: ips[i]}
+		if s, ok := row.(string); ok {
+			json.Unmarshal([]byte(s), ban)
+		}
+		result = append(result, ban)
+	}
+	return result, nil
+}
+
+// Calls handler for every ban and unban published by any instance, blocks forever
+func (r *RedisClient) SubscribeBans(handler func(ban *Ban)) error {
+	pubsub, err := r.client.Subscribe(r.formatKey("bans"))
+	if err != nil {
+		return err
+	}
+	defer pubsub.Close()
+
+	for {
+		msg, err := pubsub.ReceiveMessage()
+		if err != nil {
+			return err
+		}
+		var ban Ban
+		if err := json.Unmarshal([]byte(msg.Payload), &ban); err != nil {
+			log.Printf("Malformed ban message: %v", err)
+			continue
+		}
+		handler(&ban)
+	}
+}
@@ -0,0 +1,324 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/maoxs2/ergoPool/util"
+)
+
+// Appended shares are always synced to disk, Sync makes commit rows synced as well
+type JournalConfig struct {
+	Enabled        bool   `json:"enabled"`
+	Path           string `json:"path"`
+	Sync           bool   `json:"sync"`
+	ReplayInterval string `json:"replayInterval"`
+	DedupWindow    string `json:"dedupWindow"`
+}
+
+// Rewrite journal file once that many rows were committed and nothing is pending
+const journalCompactRows = 10000
+
+type journalRow struct {
+	Op    string `json:"op"`
+	Id    string `json:"id,omitempty"`
+	Share *Share `json:"share,omitempty"`
+}
+
+type journalEntry struct {
+	share    *Share
+	attempts int
+}
+
+// Journal is an append-only on-disk log of submitted shares and block candidates.
+// Every share is written to the journal before it goes to Redis and committed once
+// Redis accepted it, so shares submitted during a backend outage are replayed in order.
+// Submitters only append to disk, single replay goroutine writes shares to Redis.
+type Journal struct {
+	// Guards journal file and pending list, never held across backend writes
+	sync.Mutex
+	// Serialises replays, so shares reach backend in journal order
+	replayMu    sync.Mutex
+	kick        chan struct{}
+	config      *JournalConfig
+	backend     *RedisClient
+	file        *os.File
+	writer      func(share *Share, retry bool) error
+	pending     []*journalEntry
+	rows        int
+	backlogged  bool
+	intv        time.Duration
+	dedupWindow time.Duration
+	quit        chan struct{}
+	wg          sync.WaitGroup
+}
+
+func NewJournal(cfg *JournalConfig, backend *RedisClient, writer func(share *Share, retry bool) error) (*Journal, error) {
+	j := &Journal{config: cfg, backend: backend, writer: writer, quit: make(chan struct{}), kick: make(chan struct{}, 1)}
+	j.intv = util.MustParseDuration(cfg.ReplayInterval)
+	j.dedupWindow = util.MustParseDuration(cfg.DedupWindow)
+
+	err := j.load()
+	if err != nil {
+		return nil, err
+	}
+	err = j.rewrite()
+	if err != nil {
+		return nil, err
+	}
+	if len(j.pending) > 0 {
+		log.Printf("Journal has %v uncommitted shares, will replay them into backend", len(j.pending))
+		j.backlogged = true
+	}
+	return j, nil
+}
+
+func (j *Journal) Start() {
+	j.Flush()
+	timer := time.NewTimer(j.intv)
+	log.Printf("Set journal replay interval to %v", j.intv)
+
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		for {
+			select {
+			case <-j.quit:
+				timer.Stop()
+				return
+			case <-j.kick:
+				// Backlog is retried by timer only, not on every new share
+				if !j.isBacklogged() {
+					j.replay()
+				}
+			case <-timer.C:
+				j.Flush()
+				if j.Pending() == 0 {
+					_, err := j.backend.TrimShareMarkers(j.dedupWindow)
+					if err != nil {
+						log.Printf("Failed to trim journal markers in backend: %v", err)
+					}
+				}
+				timer.Reset(j.intv)
+			}
+		}
+	}()
+}
+
+// Append logs share to disk and wakes replay goroutine, it never waits for backend
+func (j *Journal) Append(share *Share) error {
+	if len(share.Id) == 0 {
+		share.Id = share.hash()
+	}
+
+	j.Lock()
+	err := j.writeRow(&journalRow{Op: "append", Share: share}, true)
+	if err != nil {
+		j.Unlock()
+		return err
+	}
+	j.pending = append(j.pending, &journalEntry{share: share})
+	j.Unlock()
+
+	select {
+	case j.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Flush replays pending shares into backend in order
+func (j *Journal) Flush() {
+	if j.Pending() == 0 {
+		return
+	}
+	n, ok := j.replay()
+	if ok && n > 0 {
+		log.Printf("Journal replayed %v shares into backend", n)
+	}
+}
+
+func (j *Journal) isBacklogged() bool {
+	j.Lock()
+	defer j.Unlock()
+	return j.backlogged
+}
+
+func (j *Journal) Pending() int {
+	j.Lock()
+	defer j.Unlock()
+	return len(j.pending)
+}
+
+// Close stops replay goroutine and waits for its current replay, then replays what backend
+// accepts and closes journal file. Shares still pending stay on disk and are replayed on next start.
+func (j *Journal) Close() error {
+	close(j.quit)
+	j.wg.Wait()
+	j.Flush()
+	if n := j.Pending(); n > 0 {
+		log.Printf("Journal closed with %v uncommitted shares", n)
+	}
+	j.Lock()
+	defer j.Unlock()
+	return j.file.Close()
+}
+
+// Writes pending shares to backend one by one. Journal lock is taken only to pick next share
+// and to commit it, so appends go on while backend is slow. Returns number of written shares
+// and whether nothing is left pending.
+func (j *Journal) replay() (int, bool) {
+	j.replayMu.Lock()
+	defer j.replayMu.Unlock()
+
+	n := 0
+	for {
+		j.Lock()
+		if len(j.pending) == 0 {
+			j.backlogged = false
+			if j.rows >= journalCompactRows {
+				err := j.rewrite()
+				if err != nil {
+					log.Printf("Failed to compact journal: %v", err)
+				}
+			}
+			j.Unlock()
+			return n, true
+		}
+		// Only replay removes entries, so head stays in place while backend write is running
+		entry := j.pending[0]
+		j.Unlock()
+
+		err := j.writer(entry.share, entry.attempts > 0)
+
+		j.Lock()
+		if err != nil {
+			entry.attempts++
+			if !j.backlogged {
+				log.Printf("Backend write failed, journaling shares until it recovers: %v", err)
+			}
+			j.backlogged = true
+			j.Unlock()
+			return n, false
+		}
+		err = j.writeRow(&journalRow{Op: "commit", Id: entry.share.Id}, j.config.Sync)
+		if err != nil {
+			log.Printf("Failed to commit share %v to journal: %v", entry.share.Id, err)
+		}
+		j.pending[0] = nil
+		j.pending = j.pending[1:]
+		j.Unlock()
+		n++
+	}
+}
+
+func (j *Journal) writeRow(row *journalRow, sync bool) error {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	_, err = j.file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	j.rows++
+	if sync {
+		return j.file.Sync()
+	}
+	return nil
+}
+
+func (j *Journal) load() error {
+	f, err := os.Open(j.config.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	committed := make(map[string]struct{})
+	var shares []*Share
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var row journalRow
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			// Torn write on crash, everything before it is still valid
+			log.Printf("Skipping malformed journal row %v: %v", line, err)
+			continue
+		}
+		switch row.Op {
+		case "append":
+			shares = append(shares, row.Share)
+		case "commit":
+			committed[row.Id] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for _, share := range shares {
+		if _, ok := committed[share.Id]; !ok {
+			// Could have reached backend before crash, so check for duplicate
+			j.pending = append(j.pending, &journalEntry{share: share, attempts: 1})
+		}
+	}
+	return nil
+}
+
+// Replace journal file with pending rows only
+func (j *Journal) rewrite() error {
+	tmp := j.config.Path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, entry := range j.pending {
+		data, err := json.Marshal(&journalRow{Op: "append", Share: entry.share})
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(data, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, j.config.Path); err != nil {
+		return err
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file, err = os.OpenFile(j.config.Path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	j.rows = len(j.pending)
+	return nil
+}
+
+func (s *Share) hash() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s:%s:%s:%d:%d", s.Login, s.Worker, s.Header, s.Height, s.Timestamp)
+	if s.Params != nil {
+		fmt.Fprintf(h, ":%s:%s:%s", s.Params.PK, s.Params.W, s.Params.N)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testWrite struct {
+	id    string
+	retry bool
+}
+
+// Backend stand-in, skips shares it already has on retry like proxy writer does
+type testJournalBackend struct {
+	down   bool
+	lost   bool
+	writes []testWrite
+	shares map[string]int
+}
+
+func (b *testJournalBackend) write(share *Share, retry bool) error {
+	b.writes = append(b.writes, testWrite{share.Id, retry})
+	if b.down {
+		return errors.New("backend is down")
+	}
+	if retry && b.shares[share.Id] > 0 {
+		return nil
+	}
+	b.shares[share.Id]++
+	if b.lost {
+		// Written, but reply did not make it back
+		return errors.New("connection reset")
+	}
+	return nil
+}
+
+func newTestJournal(t *testing.T, path string, b *testJournalBackend) *Journal {
+	cfg := &JournalConfig{Enabled: true, Path: path, ReplayInterval: "1h", DedupWindow: "1h"}
+	j, err := NewJournal(cfg, nil, b.write)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func TestJournalReplayAfterFailedWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "shares.journal")
+
+	b := &testJournalBackend{down: true, shares: make(map[string]int)}
+	j := newTestJournal(t, path, b)
+	s1 := &Share{Login: "miner1", Worker: "rig1", Header: "h1", Height: 100, Timestamp: 1}
+	s2 := &Share{Login: "miner1", Worker: "rig1", Header: "h2", Height: 100, Timestamp: 2}
+	for _, share := range []*Share{s1, s2} {
+		if err := j.Append(share); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Append only logs to disk, failed replay backlogs both shares
+	if len(b.writes) != 0 {
+		t.Fatalf("append wrote %v shares to backend", len(b.writes))
+	}
+	j.Flush()
+	if len(b.writes) != 1 || j.Pending() != 2 {
+		t.Fatalf("%v writes with %v pending, want 1 write with 2 pending", len(b.writes), j.Pending())
+	}
+
+	b.down = false
+	j.Flush()
+	want := []testWrite{{s1.Id, false}, {s1.Id, true}, {s2.Id, false}}
+	if len(b.writes) != len(want) {
+		t.Fatalf("got writes %v, want %v", b.writes, want)
+	}
+	for i := range want {
+		if b.writes[i] != want[i] {
+			t.Errorf("write %v is %v, want %v", i, b.writes[i], want[i])
+		}
+	}
+	if j.Pending() != 0 {
+		t.Errorf("%v shares still pending", j.Pending())
+	}
+
+	// Share reaches backend but reply is lost, then proxy stops
+	b.lost = true
+	s3 := &Share{Login: "miner2", Worker: "rig1", Header: "h3", Height: 101, Timestamp: 3}
+	if err := j.Append(s3); err != nil {
+		t.Fatal(err)
+	}
+	j.Flush()
+	b.lost = false
+	b.down = true
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Uncommitted share is replayed from disk as retry and not credited twice
+	b.down = false
+	b.writes = nil
+	j = newTestJournal(t, path, b)
+	if j.Pending() != 1 {
+		t.Fatalf("reloaded %v pending shares, want 1", j.Pending())
+	}
+	j.Flush()
+	if len(b.writes) != 1 || b.writes[0] != (testWrite{s3.Id, true}) {
+		t.Errorf("got writes %v, want single retry of %v", b.writes, s3.Id)
+	}
+	for id, n := range b.shares {
+		if n != 1 {
+			t.Errorf("share %v written %v times", id, n)
+		}
+	}
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	j = newTestJournal(t, path, b)
+	defer j.Close()
+	if j.Pending() != 0 {
+		t.Errorf("reloaded %v pending shares after commit", j.Pending())
+	}
+}
+
+func TestJournalAppendDoesNotWaitForBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	release := make(chan struct{})
+	written := make(chan string, 10)
+	writer := func(share *Share, retry bool) error {
+		<-release
+		written <- share.Id
+		return nil
+	}
+	cfg := &JournalConfig{Enabled: true, Path: filepath.Join(dir, "shares.journal"), ReplayInterval: "1h", DedupWindow: "1h"}
+	j, err := NewJournal(cfg, nil, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Start()
+
+	// Replay goroutine is stuck in backend write, appends still return
+	shares := []*Share{
+		{Login: "miner1", Header: "h1", Height: 100, Timestamp: 1},
+		{Login: "miner1", Header: "h2", Height: 100, Timestamp: 2},
+		{Login: "miner1", Header: "h3", Height: 100, Timestamp: 3},
+	}
+	done := make(chan error)
+	go func() {
+		for _, share := range shares {
+			if err := j.Append(share); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("append is blocked by backend write")
+	}
+
+	close(release)
+	for _, share := range shares {
+		select {
+		case id := <-written:
+			if id != share.Id {
+				t.Errorf("share %v written out of order, want %v", id, share.Id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("shares were not replayed")
+		}
+	}
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := j.Pending(); n != 0 {
+		t.Errorf("%v shares pending after close", n)
+	}
+}
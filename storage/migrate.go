@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/maoxs2/ergoPool/util"
+)
+
+// MigrateRows rewrites colon-joined block and payment rows as versioned JSON.
+// Unlocker and payouts must be stopped, they keep raw rows to remove them later.
+// Returns number of converted rows per key.
+func (r *RedisClient) MigrateRows() (map[string]int, error) {
+	result := make(map[string]int)
+
+	for _, name := range []string{"candidates", "immature", "matured"} {
+		key := r.formatKey("blocks", name)
+		convert := func(s string) (string, error) {
+			row, err := parseBlockRow(s)
+			if err != nil {
+				return "", err
+			}
+			return row.String(), nil
+		}
+		if name == "candidates" {
+			convert = func(s string) (string, error) {
+				row, err := parseCandidateRow(s)
+				if err != nil {
+					return "", err
+				}
+				return row.String(), nil
+			}
+		}
+		n, err := r.migrateKey(key, convert)
+		if err != nil {
+			return result, err
+		}
+		result[key] = n
+	}
+
+	convertPayment := func(s string) (string, error) {
+		row, err := parsePaymentRow(s)
+		if err != nil {
+			return "", err
+		}
+		return row.String(), nil
+	}
+	var c int64
+	for {
+		var keys []string
+		var err error
+		c, keys, err = r.client.Scan(c, r.formatKey("payments", "*"), 100).Result()
+		if err != nil {
+			return result, err
+		}
+		for _, key := range keys {
+			// Pending and lock rows are transient and matched as is
+			name := strings.TrimPrefix(key, r.formatKey("payments")+":")
+			if name == "pending" || name == "lock" {
+				continue
+			}
+			n, err := r.migrateKey(key, convertPayment)
+			if err != nil {
+				return result, err
+			}
+			result[key] = n
+		}
+		if c == 0 {
+			break
+		}
+	}
+	return result, nil
+}
+
+func (r *RedisClient) migrateKey(key string, convert func(string) (string, error)) (int, error) {
+	rows, err := r.client.ZRangeWithScores(key, 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	total := 0
+	_, err = tx.Exec(func() error {
+		for _, v := range rows {
+			member := v.Member.(string)
+			if isJSONRow(member) {
+				continue
+			}
+			row, err := convert(member)
+			if err != nil {
+				return err
+			}
+			tx.ZRem(key, member)
+			tx.ZAdd(key, redis.Z{Score: v.Score, Member: row})
+			total++
+		}
+		return nil
+	})
+	return total, err
+}
+
+// Amounts were stored in whole ERG before they were credited in nanoERG
+const ergToNanoErg = 1000000000
+
+// MigrateNanoErg scales balances, credits, finances and payments stored in whole ERG to nanoERG once.
+// Unlocker and payouts both run it on start before touching balances, every key is marked when
+// it is scaled, so concurrent runs don't scale it twice. Returns number of scaled keys.
+func (r *RedisClient) MigrateNanoErg() (int, error) {
+	done, err := r.client.HExists(r.formatKey("migrations"), "nanoerg").Result()
+	if err != nil || done {
+		return 0, err
+	}
+	total := 0
+
+	scaleHash := func(key, login string, fields ...string) error {
+		args := append([]string{login}, fields...)
+		scaled, err := scaleNanoErgScript.Run(r.client, []string{key, r.formatKey("migrations", "nanoerg"), r.formatKey("payees")}, args).Result()
+		if n, _ := scaled.(int64); n > 0 {
+			total++
+		}
+		return err
+	}
+
+	err = scaleHash(r.formatKey("finances"), "", "balance", "immature", "pending", "paid", "totalMined")
+	if err != nil {
+		return total, err
+	}
+	err = r.eachKey(r.formatKey("miners", "*"), func(key string) error {
+		login := strings.Split(key, ":")[2]
+		return scaleHash(key, login, "balance", "immature", "pending", "paid")
+	})
+	if err != nil {
+		return total, err
+	}
+	// Matured and immature credits per block, list of all credits holds block rewards only
+	err = r.eachKey(r.formatKey("credits", "*"), func(key string) error {
+		if key == r.formatKey("credits", "all") {
+			return nil
+		}
+		return scaleHash(key, "")
+	})
+	if err != nil {
+		return total, err
+	}
+
+	err = r.eachKey(r.formatKey("payments", "*"), func(key string) error {
+		var scaled bool
+		var err error
+		switch key {
+		case r.formatKey("payments", "lock"):
+			scaled, err = r.scaleNanoErgLock(key)
+		case r.formatKey("payments", "pending"):
+			scaled, err = r.scaleNanoErgRows(key, scalePendingPayment)
+		default:
+			scaled, err = r.scaleNanoErgRows(key, scalePaymentRow)
+		}
+		if scaled {
+			total++
+		}
+		return err
+	})
+	if err != nil {
+		return total, err
+	}
+	return total, r.client.HSet(r.formatKey("migrations"), "nanoerg", strconv.FormatInt(util.MakeTimestamp()/1000, 10)).Err()
+}
+
+// Calls fn for every key matching pattern, stops on first error
+func (r *RedisClient) eachKey(match string, fn func(key string) error) error {
+	var c int64
+	for {
+		var keys []string
+		var err error
+		c, keys, err = r.client.Scan(c, match, 100).Result()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		if c == 0 {
+			return nil
+		}
+	}
+}
+
+// Rewrites rows of sorted set and marks it scaled in one transaction, concurrent run fails it
+func (r *RedisClient) scaleNanoErgRows(key string, scale func(string) (string, error)) (bool, error) {
+	done := r.formatKey("migrations", "nanoerg")
+	tx, err := r.client.Watch(key, done)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Close()
+
+	migrated, err := tx.HExists(done, key).Result()
+	if err != nil || migrated {
+		return false, err
+	}
+	rows, err := tx.ZRangeWithScores(key, 0, -1).Result()
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(func() error {
+		for _, v := range rows {
+			member := v.Member.(string)
+			row, err := scale(member)
+			if err != nil {
+				return err
+			}
+			tx.ZRem(key, member)
+			tx.ZAdd(key, redis.Z{Score: v.Score, Member: row})
+		}
+		tx.HSet(done, key, "1")
+		return nil
+	})
+	return err == nil, err
+}
+
+// Payout lock is "login:amount" and has to match pending payment row
+func (r *RedisClient) scaleNanoErgLock(key string) (bool, error) {
+	done := r.formatKey("migrations", "nanoerg")
+	tx, err := r.client.Watch(key, done)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Close()
+
+	migrated, err := tx.HExists(done, key).Result()
+	if err != nil || migrated {
+		return false, err
+	}
+	lock, err := tx.Get(key).Result()
+	if err == redis.Nil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	scaled, err := scalePendingPayment(lock)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(func() error {
+		tx.Set(key, scaled, 0)
+		tx.HSet(done, key, "1")
+		return nil
+	})
+	return err == nil, err
+}
+
+func scalePaymentRow(s string) (string, error) {
+	row, err := parsePaymentRow(s)
+	if err != nil {
+		return "", err
+	}
+	row.Amount *= ergToNanoErg
+	return row.String(), nil
+}
+
+// Pending payment is "login:amount"
+func scalePendingPayment(s string) (string, error) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return "", fmt.Errorf("malformed pending payment %q", s)
+	}
+	amount, err := strconv.ParseInt(s[i+1:], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("malformed pending payment %q: %v", s, err)
+	}
+	return join(s[:i], amount*ergToNanoErg), nil
+}
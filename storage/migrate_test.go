@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"testing"
+
+	"gopkg.in/redis.v3"
+)
+
+func TestMigrateRows(t *testing.T) {
+	r := newTestClient(t)
+	defer closeTestClient(r)
+
+	candidates := r.formatKey("blocks", "candidates")
+	immature := r.formatKey("blocks", "immature")
+	poolPayments := r.formatKey("payments", "all")
+	minerPayments := r.formatKey("payments", "miner1")
+	pending := r.formatKey("payments", "pending")
+
+	converted := (&candidateRow{PK: "pk2", Timestamp: 2, Difficulty: bigDiff("1813006236221440000000"), TotalShares: 7}).String()
+	r.client.ZAdd(candidates,
+		redis.Z{Score: 100, Member: "pk:w:n:d:1600000000:1813006236221440000000:500"},
+		redis.Z{Score: 101, Member: converted})
+	r.client.ZAdd(immature, redis.Z{Score: 90, Member: "0:false:pk:hash:1600000000:1813006236221440000000:500:67500000000"})
+	r.client.ZAdd(poolPayments, redis.Z{Score: 1, Member: "tx:addr:1000"})
+	r.client.ZAdd(minerPayments, redis.Z{Score: 1, Member: "tx:1000"})
+	r.client.ZAdd(pending, redis.Z{Score: 1, Member: "miner1:1000"})
+
+	result, err := r.MigrateRows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{candidates: 1, immature: 1, r.formatKey("blocks", "matured"): 0, poolPayments: 1, minerPayments: 1}
+	if len(result) != len(want) {
+		t.Errorf("migrated %v, want %v", result, want)
+	}
+	for key, n := range want {
+		if result[key] != n {
+			t.Errorf("migrated %v rows of %s, want %v", result[key], key, n)
+		}
+	}
+
+	rows, _ := r.client.ZRangeWithScores(candidates, 0, -1).Result()
+	if len(rows) != 2 || rows[0].Score != 100 || rows[1].Member.(string) != converted {
+		t.Fatalf("got candidates %v", rows)
+	}
+	candidate, err := parseCandidateRow(rows[0].Member.(string))
+	if err != nil || !isJSONRow(rows[0].Member.(string)) || candidate.TotalShares != 500 ||
+		candidate.Difficulty.Cmp(bigDiff("1813006236221440000000")) != 0 {
+		t.Errorf("migrated candidate %v: %v", rows[0].Member, err)
+	}
+	rows, _ = r.client.ZRangeWithScores(immature, 0, -1).Result()
+	if block, err := parseBlockRow(rows[0].Member.(string)); err != nil || block.Version != rowVersion || block.Reward != "67500000000" {
+		t.Errorf("migrated block %v: %v", rows[0].Member, err)
+	}
+	rows, _ = r.client.ZRangeWithScores(poolPayments, 0, -1).Result()
+	if payment, err := parsePaymentRow(rows[0].Member.(string)); err != nil || payment.Version != rowVersion || payment.Address != "addr" {
+		t.Errorf("migrated payment %v: %v", rows[0].Member, err)
+	}
+	if n, _ := r.client.ZScore(pending, "miner1:1000").Result(); n != 1 {
+		t.Error("pending payment row was migrated")
+	}
+
+	// Converted rows are left alone
+	result, err = r.MigrateRows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, n := range result {
+		if n != 0 {
+			t.Errorf("second run migrated %v rows of %s", n, key)
+		}
+	}
+}
+
+func TestMigrateNanoErg(t *testing.T) {
+	r := newTestClient(t)
+	defer closeTestClient(r)
+
+	miner := r.formatKey("miners", "miner1")
+	r.client.HMSet(miner, "balance", "5", "immature", "2", "pending", "1", "paid", "10", "lastShare", "1600000000")
+	r.client.ZAdd(r.formatKey("payees"), redis.Z{Score: 5, Member: "miner1"})
+	r.client.HMSet(r.formatKey("finances"), "balance", "5", "totalMined", "67", "lastCreditHeight", "100")
+	r.client.HSet(r.formatKey("credits", "immature", int64(100), "h"), "miner1", "2")
+	r.client.ZAdd(r.formatKey("credits", "all"), redis.Z{Score: 100, Member: "h:1600000000:67500000000"})
+	r.client.ZAdd(r.formatKey("payments", "miner1"), redis.Z{Score: 1, Member: "tx:10"})
+	r.client.ZAdd(r.formatKey("payments", "pending"), redis.Z{Score: 1, Member: "miner1:1"})
+	r.client.Set(r.formatKey("payments", "lock"), "miner1:1", 0)
+
+	n, err := r.MigrateNanoErg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Errorf("migrated %v keys, want 6", n)
+	}
+	// Second run is a no-op
+	if n, err := r.MigrateNanoErg(); err != nil || n != 0 {
+		t.Errorf("second run migrated %v keys: %v", n, err)
+	}
+
+	fields, _ := r.client.HGetAllMap(miner).Result()
+	want := map[string]string{"balance": "5000000000", "immature": "2000000000", "pending": "1000000000",
+		"paid": "10000000000", "lastShare": "1600000000"}
+	for field, value := range want {
+		if fields[field] != value {
+			t.Errorf("miner %s is %v, want %v", field, fields[field], value)
+		}
+	}
+	if score, _ := r.client.ZScore(r.formatKey("payees"), "miner1").Result(); score != 5000000000 {
+		t.Errorf("payee score %v", score)
+	}
+	finances, _ := r.client.HGetAllMap(r.formatKey("finances")).Result()
+	if finances["balance"] != "5000000000" || finances["totalMined"] != "67000000000" || finances["lastCreditHeight"] != "100" {
+		t.Errorf("got finances %v", finances)
+	}
+	if v, _ := r.client.HGet(r.formatKey("credits", "immature", int64(100), "h"), "miner1").Result(); v != "2000000000" {
+		t.Errorf("immature credit %v", v)
+	}
+	if rows, _ := r.client.ZRange(r.formatKey("credits", "all"), 0, -1).Result(); rows[0] != "h:1600000000:67500000000" {
+		t.Errorf("block reward list changed: %v", rows)
+	}
+	rows, _ := r.client.ZRange(r.formatKey("payments", "miner1"), 0, -1).Result()
+	if payment, err := parsePaymentRow(rows[0]); err != nil || payment.Amount != 10000000000 {
+		t.Errorf("payment row %v: %v", rows[0], err)
+	}
+	if rows, _ := r.client.ZRange(r.formatKey("payments", "pending"), 0, -1).Result(); rows[0] != "miner1:1000000000" {
+		t.Errorf("pending payment %v", rows)
+	}
+	if lock, _ := r.client.Get(r.formatKey("payments", "lock")).Result(); lock != "miner1:1000000000" {
+		t.Errorf("payout lock %v", lock)
+	}
+}
+
+func TestScaleNanoErgRows(t *testing.T) {
+	for s, want := range map[string]int64{"tx:3": 3000000000, "tx:addr:3": 3000000000, `{"v":1,"tx":"tx","amount":3}`: 3000000000} {
+		scaled, err := scalePaymentRow(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		row, _ := parsePaymentRow(scaled)
+		if row.Amount != want || row.Tx != "tx" {
+			t.Errorf("%s scaled to %s", s, scaled)
+		}
+	}
+	if s, err := scalePendingPayment("miner1:7"); err != nil || s != "miner1:7000000000" {
+		t.Errorf("pending payment scaled to %s: %v", s, err)
+	}
+	if _, err := scalePendingPayment("miner1"); err == nil {
+		t.Error("malformed pending payment is scaled")
+	}
+}
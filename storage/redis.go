@@ -2,7 +2,7 @@ package storage
 
 import (
 	"fmt"
-	"github.com/maoxs2/ergoPool/rpc"
+	"log"
 	"math/big"
 	"strconv"
 	"strings"
@@ -10,6 +10,7 @@ import (
 
 	"gopkg.in/redis.v3"
 
+	"github.com/maoxs2/ergoPool/rpc"
 	"github.com/maoxs2/ergoPool/util"
 )
 
@@ -23,17 +24,20 @@ type Config struct {
 type RedisClient struct {
 	client *redis.Client
 	prefix string
+	// Round shares are left for retention policy instead of deleting them on maturity
+	keepRoundShares bool
 }
 
 type BlockData struct {
 	Height         int64    `json:"height"`
 	Timestamp      int64    `json:"timestamp"`
-	Difficulty     int64    `json:"difficulty"`
+	Difficulty     *big.Int `json:"difficulty"`
 	TotalShares    int64    `json:"shares"`
 	Uncle          bool     `json:"uncle"`
 	UncleHeight    int64    `json:"uncleHeight"`
 	Orphan         bool     `json:"orphan"`
 	Hash           string   `json:"hash"`
+	Header         string   `json:"-"`
 	PK             string   `json:"-"`
 	W              string   `json:"-"`
 	N              string   `json:"-"`
@@ -43,15 +47,14 @@ type BlockData struct {
 	ImmatureReward string   `json:"-"`
 	RewardString   string   `json:"reward"`
 	RoundHeight    int64    `json:"-"`
+	MaturedAt      int64    `json:"-"`
+	Nodes          []string `json:"nodes,omitempty"`
+	Solo           bool     `json:"solo,omitempty"`
+	Finder         string   `json:"finder,omitempty"`
 	candidateKey   string
 	immatureKey    string
 }
 
-func (b *BlockData) RewardInShannon() int64 {
-	reward := new(big.Int).Div(b.Reward, util.Shannon)
-	return reward.Int64()
-}
-
 func (b *BlockData) serializeHash() string {
 	if len(b.Hash) > 0 {
 		return b.Hash
@@ -64,8 +67,46 @@ func (b *BlockData) RoundKey() string {
 	return join(b.RoundHeight, b.Hash)
 }
 
+// Round shares are keyed by candidate header, rows written before it was recorded used PK
+func (b *BlockData) RoundId() string {
+	if len(b.Header) > 0 {
+		return b.Header
+	}
+	return b.PK
+}
+
 func (b *BlockData) key() string {
-	return join(b.UncleHeight, b.Orphan, b.PK, b.serializeHash(), b.Timestamp, b.Difficulty, b.TotalShares, b.Reward)
+	row := &blockRow{
+		UncleHeight: b.UncleHeight,
+		Orphan:      b.Orphan,
+		PK:          b.PK,
+		Hash:        b.serializeHash(),
+		Header:      b.Header,
+		Timestamp:   b.Timestamp,
+		Difficulty:  b.Difficulty,
+		TotalShares: b.TotalShares,
+		Reward:      join(b.Reward),
+		MaturedAt:   b.MaturedAt,
+		Solo:        b.Solo,
+		Finder:      b.Finder,
+	}
+	return row.String()
+}
+
+// Share is a single accepted submission as it goes to backend and journal
+type Share struct {
+	Id        string           `json:"id"`
+	Login     string           `json:"login"`
+	Worker    string           `json:"worker"`
+	Params    *rpc.SolutionReq `json:"params"`
+	Diff      int64            `json:"diff"`
+	RoundDiff *big.Int         `json:"roundDiff,omitempty"`
+	Height    uint64           `json:"height"`
+	Header    string           `json:"header"`
+	Block     bool             `json:"block,omitempty"`
+	Nodes     []string         `json:"nodes,omitempty"`
+	Solo      bool             `json:"solo,omitempty"`
+	Timestamp int64            `json:"timestamp"`
 }
 
 type Miner struct {
@@ -80,6 +121,36 @@ type Worker struct {
 	TotalHR int64 `json:"hr2"`
 }
 
+// Shares are accounted in fixed time buckets per miner and per worker, in seconds
+const hashrateBucket = 60
+
+type hashrateBucketData struct {
+	ts     int64
+	shares map[string]string
+}
+
+// Shares of bucket which falls into window starting at start, bucket crossing window start
+// is pro-rated, so hashrate is always divided by the window itself
+func (b *hashrateBucketData) sharesSince(share, start int64) int64 {
+	if b.ts >= start {
+		return share
+	}
+	covered := b.ts + hashrateBucket - start
+	if covered <= 0 {
+		return 0
+	}
+	return share * covered / hashrateBucket
+}
+
+// Shares are only known with bucket resolution, so last share is at most the end of bucket
+func (b *hashrateBucketData) lastBeat(now int64) int64 {
+	end := b.ts + hashrateBucket - 1
+	if end > now {
+		return now
+	}
+	return end
+}
+
 func NewRedisClient(cfg *Config, prefix string) *RedisClient {
 	client := redis.NewClient(&redis.Options{
 		Addr:     cfg.Endpoint,
@@ -90,6 +161,10 @@ func NewRedisClient(cfg *Config, prefix string) *RedisClient {
 	return &RedisClient{client: client, prefix: prefix}
 }
 
+func (r *RedisClient) SetKeepRoundShares(keep bool) {
+	r.keepRoundShares = keep
+}
+
 func (r *RedisClient) Client() *redis.Client {
 	return r.client
 }
@@ -98,6 +173,10 @@ func (r *RedisClient) Check() (string, error) {
 	return r.client.Ping().Result()
 }
 
+func (r *RedisClient) Close() error {
+	return r.client.Close()
+}
+
 func (r *RedisClient) BgSave() (string, error) {
 	return r.client.BgSave().Result()
 }
@@ -111,7 +190,16 @@ func (r *RedisClient) GetBlacklist() ([]string, error) {
 	return cmd.Val(), nil
 }
 
-// Always returns list of IPs. If Redis fails it will return empty list.
+// Always returns list of IPs and CIDR ranges. If Redis fails it will return empty list.
+func (r *RedisClient) GetIPBlacklist() ([]string, error) {
+	cmd := r.client.SMembers(r.formatKey("ipblacklist"))
+	if cmd.Err() != nil {
+		return []string{}, cmd.Err()
+	}
+	return cmd.Val(), nil
+}
+
+// Always returns list of IPs and CIDR ranges. If Redis fails it will return empty list.
 func (r *RedisClient) GetWhitelist() ([]string, error) {
 	cmd := r.client.SMembers(r.formatKey("whitelist"))
 	if cmd.Err() != nil {
@@ -120,7 +208,7 @@ func (r *RedisClient) GetWhitelist() ([]string, error) {
 	return cmd.Val(), nil
 }
 
-func (r *RedisClient) WriteNodeState(id string, height uint64, diff *big.Int) error {
+func (r *RedisClient) WriteNodeState(id string, height uint64, diff *big.Int, rejects map[string]int64) error {
 	tx := r.client.Multi()
 	defer tx.Close()
 
@@ -131,11 +219,52 @@ func (r *RedisClient) WriteNodeState(id string, height uint64, diff *big.Int) er
 		tx.HSet(r.formatKey("nodes"), join(id, "height"), strconv.FormatUint(height, 10))
 		tx.HSet(r.formatKey("nodes"), join(id, "difficulty"), diff.String())
 		tx.HSet(r.formatKey("nodes"), join(id, "lastBeat"), strconv.FormatInt(now, 10))
+		for reason, n := range rejects {
+			tx.HSet(r.formatKey("nodes"), join(id, reason), strconv.FormatInt(n, 10))
+		}
 		return nil
 	})
 	return err
 }
 
+func (r *RedisClient) WriteNodeConfigVersion(id, version string) error {
+	return r.client.HSet(r.formatKey("nodes"), join(id, "configVersion"), version).Err()
+}
+
+// Upstreams of proxy instance are kept as "id:upstreams:name:field" in nodes hash
+func (r *RedisClient) WriteUpstreamStates(id string, states map[string]map[string]interface{}) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		for name, state := range states {
+			for field, value := range state {
+				tx.HSet(r.formatKey("nodes"), join(id, "upstreams", name, field), fmt.Sprint(value))
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// Difficulty reported by most recently updated proxy node
+func (r *RedisClient) GetNetworkDifficulty() (*big.Int, error) {
+	nodes, err := r.GetNodeStates()
+	if err != nil {
+		return nil, err
+	}
+	var diff *big.Int
+	var lastBeat int64
+	for _, node := range nodes {
+		beat, _ := strconv.ParseInt(fmt.Sprint(node["lastBeat"]), 10, 64)
+		d, ok := new(big.Int).SetString(fmt.Sprint(node["difficulty"]), 10)
+		if ok && d.Sign() > 0 && beat >= lastBeat {
+			diff, lastBeat = d, beat
+		}
+	}
+	return diff, nil
+}
+
 func (r *RedisClient) GetNodeStates() ([]map[string]interface{}, error) {
 	cmd := r.client.HGetAllMap(r.formatKey("nodes"))
 	if cmd.Err() != nil {
@@ -144,13 +273,25 @@ func (r *RedisClient) GetNodeStates() ([]map[string]interface{}, error) {
 	m := make(map[string]map[string]interface{})
 	for key, value := range cmd.Val() {
 		parts := strings.Split(key, ":")
-		if val, ok := m[parts[0]]; ok {
-			val[parts[1]] = value
-		} else {
-			node := make(map[string]interface{})
-			node[parts[1]] = value
+		node, ok := m[parts[0]]
+		if !ok {
+			node = make(map[string]interface{})
 			m[parts[0]] = node
 		}
+		switch {
+		case len(parts) == 2:
+			node[parts[1]] = value
+		case len(parts) == 4 && parts[1] == "upstreams":
+			upstreams, ok := node["upstreams"].(map[string]map[string]string)
+			if !ok {
+				upstreams = make(map[string]map[string]string)
+				node["upstreams"] = upstreams
+			}
+			if _, ok := upstreams[parts[2]]; !ok {
+				upstreams[parts[2]] = make(map[string]string)
+			}
+			upstreams[parts[2]][parts[3]] = value
+		}
 	}
 	v := make([]map[string]interface{}, len(m), len(m))
 	i := 0
@@ -168,7 +309,7 @@ func (r *RedisClient) checkPoWExist(height uint64, params []string) (bool, error
 	return val == 0, err
 }
 
-func (r *RedisClient) WriteShare(login, id string, params *rpc.SolutionReq, diff int64, height uint64, window time.Duration) (bool, error) {
+func (r *RedisClient) WriteShare(share *Share, window time.Duration) (bool, error) {
 	//exist, err := r.checkPoWExist(height, params)
 	//if err != nil {
 	//	return false, err
@@ -180,18 +321,18 @@ func (r *RedisClient) WriteShare(login, id string, params *rpc.SolutionReq, diff
 	tx := r.client.Multi()
 	defer tx.Close()
 
-	ms := util.MakeTimestamp()
+	ms := share.Timestamp
 	ts := ms / 1000
 
 	_, err := tx.Exec(func() error {
-		r.writeShare(tx, ms, ts, login, id, diff, window)
-		tx.HIncrBy(r.formatKey("stats"), "roundShares", diff)
+		r.writeShare(tx, ms, ts, share, window)
+		tx.HIncrBy(r.formatKey("stats"), "roundShares", share.Diff)
 		return nil
 	})
 	return false, err
 }
 
-func (r *RedisClient) WriteBlock(login, id string, params *rpc.SolutionReq, diff, roundDiff int64, height uint64, window time.Duration, header string) (bool, error) {
+func (r *RedisClient) WriteBlock(share *Share, window time.Duration) (bool, error) {
 	//exist, err := r.checkPoWExist(height, params)
 	//if err != nil {
 	//	return false, err
@@ -200,44 +341,113 @@ func (r *RedisClient) WriteBlock(login, id string, params *rpc.SolutionReq, diff
 	//if exist {
 	//	return true, nil
 	//}
-	tx := r.client.Multi()
-	defer tx.Close()
+	script, keys, args := r.blockScript(share, window)
+	err := script.Run(r.client, keys, args).Err()
+	return false, err
+}
 
-	ms := util.MakeTimestamp()
+// Picks block script for share and lays out its KEYS and ARGV as documented in scripts.go
+func (r *RedisClient) blockScript(share *Share, window time.Duration) (*redis.Script, []string, []string) {
+	ms := share.Timestamp
 	ts := ms / 1000
+	height := int64(share.Height)
+	bucket := ts - ts%hashrateBucket
 
-	cmds, err := tx.Exec(func() error {
-		r.writeShare(tx, ms, ts, login, id, diff, window)
-		tx.HSet(r.formatKey("stats"), "lastBlockFound", strconv.FormatInt(ts, 10))
-		tx.HDel(r.formatKey("stats"), "roundShares")
-		tx.ZIncrBy(r.formatKey("finders"), 1, login)
-		tx.HIncrBy(r.formatKey("miners", login), "blocksFound", 1)
-		tx.Rename(r.formatKey("shares", "roundCurrent"), r.formatRound(int64(height), header))
-		tx.HGetAllMap(r.formatRound(int64(height), header))
-		return nil
-	})
-	if err != nil {
-		return false, err
+	params := share.Params
+	var d string
+	if params.D != nil {
+		d = params.D.String()
+	}
+	row := &candidateRow{
+		PK:         params.PK,
+		W:          params.W,
+		N:          params.N,
+		D:          d,
+		Header:     share.Header,
+		Timestamp:  ts,
+		Difficulty: share.RoundDiff,
+		Nodes:      share.Nodes,
+		Solo:       share.Solo,
+	}
+	var script *redis.Script
+	var keys []string
+	if share.Solo {
+		row.Finder = share.Login
+		script = writeSoloBlockScript
+		keys = []string{
+			r.formatKey("miners", share.Login),
+			r.formatRound(height, share.Header),
+			r.formatKey("stats"),
+			r.formatKey("finders"),
+			r.formatKey("hashrate", "pool", bucket),
+			r.formatKey("hashrate", share.Login, bucket),
+			r.formatKey("journal"),
+			r.formatKey("blocks", "candidates"),
+		}
 	} else {
-		sharesMap, _ := cmds[10].(*redis.StringStringMapCmd).Result()
-		totalShares := int64(0)
-		for _, v := range sharesMap {
-			n, _ := strconv.ParseInt(v, 10, 64)
-			totalShares += n
+		script = writeBlockScript
+		keys = []string{
+			r.formatKey("shares", "roundCurrent"),
+			r.formatRound(height, share.Header),
+			r.formatKey("stats"),
+			r.formatKey("finders"),
+			r.formatKey("miners", share.Login),
+			r.formatKey("hashrate", "pool", bucket),
+			r.formatKey("hashrate", share.Login, bucket),
+			r.formatKey("journal"),
+			r.formatKey("blocks", "candidates"),
 		}
-		hashHex := strings.Join([]string{params.PK, params.W, params.N , params.Hash.String() }, ":")
-		s := join(hashHex, ts, roundDiff, totalShares)
-		cmd := r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: float64(height), Member: s})
-		return false, cmd.Err()
 	}
+	args := []string{
+		share.Login,
+		share.Worker,
+		strconv.FormatInt(share.Diff, 10),
+		strconv.FormatInt(ts, 10),
+		strconv.FormatInt(int64(window/time.Second), 10),
+		strconv.FormatInt(height, 10),
+		row.prefix(),
+		share.Id,
+		strconv.FormatInt(ms, 10),
+	}
+	return script, keys, args
 }
 
-func (r *RedisClient) writeShare(tx *redis.Multi, ms, ts int64, login, id string, diff int64, expire time.Duration) {
-	tx.HIncrBy(r.formatKey("shares", "roundCurrent"), login, diff)
-	tx.ZAdd(r.formatKey("hashrate"), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
-	tx.ZAdd(r.formatKey("hashrate", login), redis.Z{Score: float64(ts), Member: join(diff, id, ms)})
-	tx.Expire(r.formatKey("hashrate", login), expire) // Will delete hashrates for miners that gone
+// Block shares are credited by writeBlockScript, keep both in sync
+func (r *RedisClient) writeShare(tx *redis.Multi, ms, ts int64, share *Share, expire time.Duration) {
+	login, id, diff := share.Login, share.Worker, share.Diff
+	bucket := ts - ts%hashrateBucket
+	// Solo shares are miner's own round and don't count for pool round
+	if share.Solo {
+		tx.HIncrBy(r.formatKey("miners", login), "soloShares", diff)
+	} else {
+		tx.HIncrBy(r.formatKey("shares", "roundCurrent"), login, diff)
+	}
+	tx.HIncrBy(r.formatKey("hashrate", "pool", bucket), login, diff)
+	tx.Expire(r.formatKey("hashrate", "pool", bucket), expire)
+	tx.HIncrBy(r.formatKey("hashrate", login, bucket), id, diff)
+	tx.Expire(r.formatKey("hashrate", login, bucket), expire) // Will delete hashrates for miners that gone
 	tx.HSet(r.formatKey("miners", login), "lastShare", strconv.FormatInt(ts, 10))
+	// Journaled share, remember it to skip duplicates on replay
+	if len(share.Id) > 0 {
+		tx.ZAdd(r.formatKey("journal"), redis.Z{Score: float64(ms), Member: share.Id})
+	}
+}
+
+func (r *RedisClient) IsShareWritten(id string) (bool, error) {
+	err := r.client.ZScore(r.formatKey("journal"), id).Err()
+	if err == redis.Nil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Drop replay markers of journaled shares older than window
+func (r *RedisClient) TrimShareMarkers(window time.Duration) (int64, error) {
+	now := util.MakeTimestamp()
+	max := fmt.Sprint("(", now-int64(window/time.Millisecond))
+	return r.client.ZRemRangeByScore(r.formatKey("journal"), "-inf", max).Result()
 }
 
 func (r *RedisClient) formatKey(args ...interface{}) string {
@@ -312,30 +522,60 @@ func (r *RedisClient) GetRoundShares(height int64, nonce string) (map[string]int
 	return result, nil
 }
 
-func (r *RedisClient) GetPayees() ([]string, error) {
-	payees := make(map[string]struct{})
-	var result []string
-	var c int64
+type Payee struct {
+	Login   string `json:"login"`
+	Balance int64  `json:"balance"`
+}
+
+// Returns accounts with balance above threshold using payees index
+func (r *RedisClient) GetPayees(threshold int64) ([]*Payee, error) {
+	option := redis.ZRangeByScore{Min: "(" + strconv.FormatInt(threshold, 10), Max: "+inf"}
+	cmd := r.client.ZRangeByScoreWithScores(r.formatKey("payees"), option)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertPayeesResults(cmd), nil
+}
+
+func (r *RedisClient) GetTopBalances(max int64) ([]*Payee, error) {
+	cmd := r.client.ZRevRangeWithScores(r.formatKey("payees"), 0, max-1)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertPayeesResults(cmd), nil
+}
+
+// Builds payees index from balances once, index is kept by balance updates since.
+// Done marker is separate from index itself, unlocker may credit payees before first payouts run.
+func (r *RedisClient) IndexPayees() (int, error) {
+	done, err := r.client.HExists(r.formatKey("migrations"), "payees").Result()
+	if err != nil || done {
+		return 0, err
+	}
 
+	var c int64
+	total := 0
 	for {
 		var keys []string
-		var err error
 		c, keys, err = r.client.Scan(c, r.formatKey("miners", "*"), 100).Result()
 		if err != nil {
-			return nil, err
+			return total, err
 		}
 		for _, row := range keys {
 			login := strings.Split(row, ":")[2]
-			payees[login] = struct{}{}
+			indexed, err := indexPayeeScript.Run(r.client, []string{row, r.formatKey("payees")}, []string{login}).Result()
+			if err != nil {
+				return total, err
+			}
+			if n, _ := indexed.(int64); n > 0 {
+				total++
+			}
 		}
 		if c == 0 {
 			break
 		}
 	}
-	for login, _ := range payees {
-		result = append(result, login)
-	}
-	return result, nil
+	return total, r.client.HSet(r.formatKey("migrations"), "payees", strconv.FormatInt(util.MakeTimestamp()/1000, 10)).Err()
 }
 
 func (r *RedisClient) GetBalance(login string) (int64, error) {
@@ -405,6 +645,8 @@ func (r *RedisClient) UpdateBalance(login string, amount int64) error {
 	_, err := tx.Exec(func() error {
 		tx.HIncrBy(r.formatKey("miners", login), "balance", (amount * -1))
 		tx.HIncrBy(r.formatKey("miners", login), "pending", amount)
+		tx.ZIncrBy(r.formatKey("payees"), float64(amount*-1), login)
+		tx.ZRemRangeByScore(r.formatKey("payees"), "-inf", "0")
 		tx.HIncrBy(r.formatKey("finances"), "balance", (amount * -1))
 		tx.HIncrBy(r.formatKey("finances"), "pending", amount)
 		tx.ZAdd(r.formatKey("payments", "pending"), redis.Z{Score: float64(ts), Member: join(login, amount)})
@@ -420,6 +662,7 @@ func (r *RedisClient) RollbackBalance(login string, amount int64) error {
 	_, err := tx.Exec(func() error {
 		tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
 		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
+		tx.ZIncrBy(r.formatKey("payees"), float64(amount), login)
 		tx.HIncrBy(r.formatKey("finances"), "balance", amount)
 		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
 		tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
@@ -439,8 +682,10 @@ func (r *RedisClient) WritePayment(login, txHash string, amount int64) error {
 		tx.HIncrBy(r.formatKey("miners", login), "paid", amount)
 		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
 		tx.HIncrBy(r.formatKey("finances"), "paid", amount)
-		tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: join(txHash, login, amount)})
-		tx.ZAdd(r.formatKey("payments", login), redis.Z{Score: float64(ts), Member: join(txHash, amount)})
+		all := &paymentRow{Tx: txHash, Address: login, Amount: amount}
+		tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: all.String()})
+		own := &paymentRow{Tx: txHash, Amount: amount}
+		tx.ZAdd(r.formatKey("payments", login), redis.Z{Score: float64(ts), Member: own.String()})
 		tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
 		tx.Del(r.formatKey("payments", "lock"))
 		return nil
@@ -497,6 +742,7 @@ func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[strin
 			total += amount
 			// NOTICE: Maybe expire round reward entry in 604800 (a week)?
 			tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
+			tx.ZIncrBy(r.formatKey("payees"), float64(amount), login)
 			tx.HSetNX(r.formatKey("credits", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
 		}
 		tx.Del(creditKey)
@@ -504,7 +750,7 @@ func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[strin
 		tx.HIncrBy(r.formatKey("finances"), "immature", (totalImmature * -1))
 		tx.HSet(r.formatKey("finances"), "lastCreditHeight", strconv.FormatInt(block.Height, 10))
 		tx.HSet(r.formatKey("finances"), "lastCreditHash", block.Hash)
-		tx.HIncrBy(r.formatKey("finances"), "totalMined", block.RewardInShannon())
+		tx.HIncrBy(r.formatKey("finances"), "totalMined", block.Reward.Int64())
 		return nil
 	})
 	return err
@@ -553,14 +799,18 @@ func (r *RedisClient) WritePendingOrphans(blocks []*BlockData) error {
 func (r *RedisClient) writeImmatureBlock(tx *redis.Multi, block *BlockData) {
 	// Redis 2.8.x returns "ERR source and destination objects are the same"
 	if block.Height != block.RoundHeight {
-		tx.Rename(r.formatRound(block.RoundHeight, block.PK), r.formatRound(block.Height, block.PK))
+		tx.Rename(r.formatRound(block.RoundHeight, block.RoundId()), r.formatRound(block.Height, block.RoundId()))
 	}
 	tx.ZRem(r.formatKey("blocks", "candidates"), block.candidateKey)
 	tx.ZAdd(r.formatKey("blocks", "immature"), redis.Z{Score: float64(block.Height), Member: block.key()})
 }
 
+// Round shares are deleted on maturity unless they are kept for retention policy and dropped by PurgeRound
 func (r *RedisClient) writeMaturedBlock(tx *redis.Multi, block *BlockData) {
-	tx.Del(r.formatRound(block.RoundHeight, block.PK))
+	block.MaturedAt = util.MakeTimestamp() / 1000
+	if !r.keepRoundShares {
+		tx.Del(r.formatRound(block.RoundHeight, block.RoundId()))
+	}
 	tx.ZRem(r.formatKey("blocks", "immature"), block.immatureKey)
 	tx.ZAdd(r.formatKey("blocks", "matured"), redis.Z{Score: float64(block.Height), Member: block.key()})
 }
@@ -580,6 +830,7 @@ func (r *RedisClient) GetMinerStats(login string, maxPayments int64) (map[string
 		tx.ZRevRangeWithScores(r.formatKey("payments", login), 0, maxPayments-1)
 		tx.ZCard(r.formatKey("payments", login))
 		tx.HGet(r.formatKey("shares", "roundCurrent"), login)
+		tx.HGet(r.formatKey("miners", login), "soloShares")
 		return nil
 	})
 
@@ -593,6 +844,8 @@ func (r *RedisClient) GetMinerStats(login string, maxPayments int64) (map[string
 		stats["paymentsTotal"] = cmds[2].(*redis.IntCmd).Val()
 		roundShares, _ := cmds[3].(*redis.StringCmd).Int64()
 		stats["roundShares"] = roundShares
+		soloShares, _ := cmds[4].(*redis.StringCmd).Int64()
+		stats["soloShares"] = soloShares
 	}
 
 	return stats, nil
@@ -611,42 +864,79 @@ func convertStringMap(m map[string]string) map[string]interface{} {
 	return result
 }
 
-// WARNING: Must run it periodically to flush out of window hashrate entries
-func (r *RedisClient) FlushStaleStats(window, largeWindow time.Duration) (int64, error) {
-	now := util.MakeTimestamp() / 1000
-	max := fmt.Sprint("(", now-int64(window/time.Second))
-	total, err := r.client.ZRemRangeByScore(r.formatKey("hashrate"), "-inf", max).Result()
+// Hashrate buckets expire on their own, this only drops sorted sets left by per-share accounting:
+// pool-wide set and per-miner sets, latter are looked up once since buckets share their key prefix.
+func (r *RedisClient) FlushStaleStats() (int64, error) {
+	total, err := r.dropLegacyHashrate(r.formatKey("hashrate"))
 	if err != nil {
 		return total, err
 	}
+	done, err := r.client.HExists(r.formatKey("migrations"), "hashrate").Result()
+	if err != nil || done {
+		return total, err
+	}
 
+	base := r.formatKey("hashrate") + ":"
 	var c int64
-	miners := make(map[string]struct{})
-	max = fmt.Sprint("(", now-int64(largeWindow/time.Second))
-
 	for {
 		var keys []string
-		var err error
-		c, keys, err = r.client.Scan(c, r.formatKey("hashrate", "*"), 100).Result()
+		c, keys, err = r.client.Scan(c, base+"*", 100).Result()
 		if err != nil {
 			return total, err
 		}
-		for _, row := range keys {
-			login := strings.Split(row, ":")[2]
-			if _, ok := miners[login]; !ok {
-				n, err := r.client.ZRemRangeByScore(r.formatKey("hashrate", login), "-inf", max).Result()
-				if err != nil {
-					return total, err
-				}
-				miners[login] = struct{}{}
-				total += n
+		for _, key := range keys {
+			// Buckets are hashrate:<login>:<ts>
+			if strings.Contains(key[len(base):], ":") {
+				continue
+			}
+			n, err := r.dropLegacyHashrate(key)
+			if err != nil {
+				return total, err
 			}
+			total += n
 		}
 		if c == 0 {
 			break
 		}
 	}
-	return total, nil
+	return total, r.client.HSet(r.formatKey("migrations"), "hashrate", strconv.FormatInt(util.MakeTimestamp()/1000, 10)).Err()
+}
+
+func (r *RedisClient) dropLegacyHashrate(key string) (int64, error) {
+	kind, err := r.client.Type(key).Result()
+	if err != nil || kind != "zset" {
+		return 0, err
+	}
+	total, err := r.client.ZCard(key).Result()
+	if err != nil {
+		return 0, err
+	}
+	return total, r.client.Del(key).Err()
+}
+
+// Reads per-bucket share totals for the last window seconds, oldest bucket first
+func (r *RedisClient) getHashrateBuckets(now, window int64, args ...interface{}) ([]hashrateBucketData, error) {
+	first := now - window
+	first -= first % hashrateBucket
+
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	var buckets []hashrateBucketData
+	cmds, err := tx.Exec(func() error {
+		for ts := first; ts <= now; ts += hashrateBucket {
+			tx.HGetAllMap(r.formatKey(append(args, ts)...))
+			buckets = append(buckets, hashrateBucketData{ts: ts})
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	for i, cmd := range cmds {
+		buckets[i].shares, _ = cmd.(*redis.StringStringMapCmd).Result()
+	}
+	return buckets, nil
 }
 
 func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPayments int64) (map[string]interface{}, error) {
@@ -659,8 +949,6 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 	now := util.MakeTimestamp() / 1000
 
 	cmds, err := tx.Exec(func() error {
-		tx.ZRemRangeByScore(r.formatKey("hashrate"), "-inf", fmt.Sprint("(", now-window))
-		tx.ZRangeWithScores(r.formatKey("hashrate"), 0, -1)
 		tx.HGetAllMap(r.formatKey("stats"))
 		tx.ZRevRangeWithScores(r.formatKey("blocks", "candidates"), 0, -1)
 		tx.ZRevRangeWithScores(r.formatKey("blocks", "immature"), 0, -1)
@@ -677,25 +965,29 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 		return nil, err
 	}
 
-	result, _ := cmds[2].(*redis.StringStringMapCmd).Result()
+	result, _ := cmds[0].(*redis.StringStringMapCmd).Result()
 	stats["stats"] = convertStringMap(result)
-	candidates := convertCandidateResults(cmds[3].(*redis.ZSliceCmd))
+	candidates := convertCandidateResults(cmds[1].(*redis.ZSliceCmd))
 	stats["candidates"] = candidates
-	stats["candidatesTotal"] = cmds[6].(*redis.IntCmd).Val()
+	stats["candidatesTotal"] = cmds[4].(*redis.IntCmd).Val()
 
-	immature := convertBlockResults(cmds[4].(*redis.ZSliceCmd))
+	immature := convertBlockResults(cmds[2].(*redis.ZSliceCmd))
 	stats["immature"] = immature
-	stats["immatureTotal"] = cmds[7].(*redis.IntCmd).Val()
+	stats["immatureTotal"] = cmds[5].(*redis.IntCmd).Val()
 
-	matured := convertBlockResults(cmds[5].(*redis.ZSliceCmd))
+	matured := convertBlockResults(cmds[3].(*redis.ZSliceCmd))
 	stats["matured"] = matured
-	stats["maturedTotal"] = cmds[8].(*redis.IntCmd).Val()
+	stats["maturedTotal"] = cmds[6].(*redis.IntCmd).Val()
 
-	payments := convertPaymentsResults(cmds[10].(*redis.ZSliceCmd))
+	payments := convertPaymentsResults(cmds[8].(*redis.ZSliceCmd))
 	stats["payments"] = payments
-	stats["paymentsTotal"] = cmds[9].(*redis.IntCmd).Val()
+	stats["paymentsTotal"] = cmds[7].(*redis.IntCmd).Val()
 
-	totalHashrate, miners := convertMinersStats(window, cmds[1].(*redis.ZSliceCmd))
+	buckets, err := r.getHashrateBuckets(now, window, "hashrate", "pool")
+	if err != nil {
+		return nil, err
+	}
+	totalHashrate, miners := convertMinersStats(now, window, buckets)
 	stats["miners"] = miners
 	stats["minersTotal"] = len(miners)
 	stats["hashrate"] = totalHashrate
@@ -707,17 +999,9 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 	largeWindow := int64(lWindow / time.Second)
 	stats := make(map[string]interface{})
 
-	tx := r.client.Multi()
-	defer tx.Close()
-
 	now := util.MakeTimestamp() / 1000
 
-	cmds, err := tx.Exec(func() error {
-		tx.ZRemRangeByScore(r.formatKey("hashrate", login), "-inf", fmt.Sprint("(", now-largeWindow))
-		tx.ZRangeWithScores(r.formatKey("hashrate", login), 0, -1)
-		return nil
-	})
-
+	buckets, err := r.getHashrateBuckets(now, largeWindow, "hashrate", login)
 	if err != nil {
 		return nil, err
 	}
@@ -726,7 +1010,7 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 	currentHashrate := int64(0)
 	online := int64(0)
 	offline := int64(0)
-	workers := convertWorkersStats(smallWindow, cmds[1].(*redis.ZSliceCmd))
+	workers := convertWorkersStats(now, smallWindow, largeWindow, buckets)
 
 	for id, worker := range workers {
 		timeOnline := now - worker.startedAt
@@ -787,8 +1071,12 @@ func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, e
 	calcLuck := func(max int) (int, float64, float64, float64) {
 		var total int
 		var sharesDiff, uncles, orphans float64
-		for i, block := range blocks {
-			if i > (max - 1) {
+		for _, block := range blocks {
+			// Solo rounds are finder's own effort, shown as soloEffort of account
+			if block.Solo {
+				continue
+			}
+			if total >= max {
 				break
 			}
 			if block.Uncle {
@@ -797,8 +1085,12 @@ func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, e
 			if block.Orphan {
 				orphans++
 			}
-			sharesDiff += float64(block.TotalShares) / float64(block.Difficulty)
 			total++
+			if block.Difficulty == nil || block.Difficulty.Sign() <= 0 {
+				continue
+			}
+			luck, _ := new(big.Rat).SetFrac(big.NewInt(block.TotalShares), block.Difficulty).Float64()
+			sharesDiff += luck
 		}
 		if total > 0 {
 			sharesDiff /= float64(total)
@@ -823,18 +1115,25 @@ func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, e
 func convertCandidateResults(raw *redis.ZSliceCmd) []*BlockData {
 	var result []*BlockData
 	for _, v := range raw.Val() {
-		// "nonce:powHash:mixDigest:timestamp:diff:totalShares"
+		row, err := parseCandidateRow(v.Member.(string))
+		if err != nil {
+			log.Printf("Skipping block candidate at height %v: %v", int64(v.Score), err)
+			continue
+		}
 		block := BlockData{}
 		block.Height = int64(v.Score)
 		block.RoundHeight = block.Height
-		fields := strings.Split(v.Member.(string), ":")
-		block.PK = fields[0]
-		block.W = fields[1]
-		block.N = fields[2]
-		block.D = fields[3]
-		block.Timestamp, _ = strconv.ParseInt(fields[4], 10, 64)
-		block.Difficulty, _ = strconv.ParseInt(fields[5], 10, 64)
-		block.TotalShares, _ = strconv.ParseInt(fields[6], 10, 64)
+		block.PK = row.PK
+		block.W = row.W
+		block.N = row.N
+		block.D = row.D
+		block.Header = row.Header
+		block.Timestamp = row.Timestamp
+		block.Difficulty = row.Difficulty
+		block.TotalShares = row.TotalShares
+		block.Nodes = row.Nodes
+		block.Solo = row.Solo
+		block.Finder = row.Finder
 		block.candidateKey = v.Member.(string)
 		result = append(result, &block)
 	}
@@ -843,23 +1142,30 @@ func convertCandidateResults(raw *redis.ZSliceCmd) []*BlockData {
 
 func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
 	var result []*BlockData
-	for _, row := range rows {
-		for _, v := range row.Val() {
-			// "uncleHeight:orphan:nonce:blockHash:timestamp:diff:totalShares:rewardInWei"
+	for _, raw := range rows {
+		for _, v := range raw.Val() {
+			row, err := parseBlockRow(v.Member.(string))
+			if err != nil {
+				log.Printf("Skipping block at height %v: %v", int64(v.Score), err)
+				continue
+			}
 			block := BlockData{}
 			block.Height = int64(v.Score)
 			block.RoundHeight = block.Height
-			fields := strings.Split(v.Member.(string), ":")
-			block.UncleHeight, _ = strconv.ParseInt(fields[0], 10, 64)
+			block.UncleHeight = row.UncleHeight
 			block.Uncle = block.UncleHeight > 0
-			block.Orphan, _ = strconv.ParseBool(fields[1])
-			block.PK = fields[2]
-			block.Hash = fields[3]
-			block.Timestamp, _ = strconv.ParseInt(fields[4], 10, 64)
-			block.Difficulty, _ = strconv.ParseInt(fields[5], 10, 64)
-			block.TotalShares, _ = strconv.ParseInt(fields[6], 10, 64)
-			block.RewardString = fields[7]
-			block.ImmatureReward = fields[7]
+			block.Orphan = row.Orphan
+			block.PK = row.PK
+			block.Hash = row.Hash
+			block.Header = row.Header
+			block.Timestamp = row.Timestamp
+			block.Difficulty = row.Difficulty
+			block.TotalShares = row.TotalShares
+			block.RewardString = row.Reward
+			block.ImmatureReward = row.Reward
+			block.MaturedAt = row.MaturedAt
+			block.Solo = row.Solo
+			block.Finder = row.Finder
 			block.immatureKey = v.Member.(string)
 			result = append(result, &block)
 		}
@@ -868,57 +1174,48 @@ func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
 }
 
 // Build per login workers's total shares map {'rig-1': 12345, 'rig-2': 6789, ...}
-// TS => diff, id, ms
-func convertWorkersStats(window int64, raw *redis.ZSliceCmd) map[string]Worker {
-	now := util.MakeTimestamp() / 1000
+// Bucket => id, diff
+func convertWorkersStats(now, smallWindow, largeWindow int64, buckets []hashrateBucketData) map[string]Worker {
 	workers := make(map[string]Worker)
 
-	for _, v := range raw.Val() {
-		parts := strings.Split(v.Member.(string), ":")
-		share, _ := strconv.ParseInt(parts[0], 10, 64)
-		id := parts[1]
-		score := int64(v.Score)
-		worker := workers[id]
-
-		// Add for large window
-		worker.TotalHR += share
+	for _, bucket := range buckets {
+		for id, v := range bucket.shares {
+			share, _ := strconv.ParseInt(v, 10, 64)
+			worker := workers[id]
+			worker.TotalHR += bucket.sharesSince(share, now-largeWindow)
+			worker.HR += bucket.sharesSince(share, now-smallWindow)
 
-		// Add for small window if matches
-		if score >= now-window {
-			worker.HR += share
-		}
-
-		if worker.LastBeat < score {
-			worker.LastBeat = score
-		}
-		if worker.startedAt > score || worker.startedAt == 0 {
-			worker.startedAt = score
+			if lastBeat := bucket.lastBeat(now); worker.LastBeat < lastBeat {
+				worker.LastBeat = lastBeat
+			}
+			if worker.startedAt > bucket.ts || worker.startedAt == 0 {
+				worker.startedAt = bucket.ts
+			}
+			workers[id] = worker
 		}
-		workers[id] = worker
 	}
 	return workers
 }
 
-func convertMinersStats(window int64, raw *redis.ZSliceCmd) (int64, map[string]Miner) {
-	now := util.MakeTimestamp() / 1000
+// Bucket => login, diff
+func convertMinersStats(now, window int64, buckets []hashrateBucketData) (int64, map[string]Miner) {
 	miners := make(map[string]Miner)
 	totalHashrate := int64(0)
 
-	for _, v := range raw.Val() {
-		parts := strings.Split(v.Member.(string), ":")
-		share, _ := strconv.ParseInt(parts[0], 10, 64)
-		id := parts[1]
-		score := int64(v.Score)
-		miner := miners[id]
-		miner.HR += share
+	for _, bucket := range buckets {
+		for id, v := range bucket.shares {
+			share, _ := strconv.ParseInt(v, 10, 64)
+			miner := miners[id]
+			miner.HR += bucket.sharesSince(share, now-window)
 
-		if miner.LastBeat < score {
-			miner.LastBeat = score
-		}
-		if miner.startedAt > score || miner.startedAt == 0 {
-			miner.startedAt = score
+			if lastBeat := bucket.lastBeat(now); miner.LastBeat < lastBeat {
+				miner.LastBeat = lastBeat
+			}
+			if miner.startedAt > bucket.ts || miner.startedAt == 0 {
+				miner.startedAt = bucket.ts
+			}
+			miners[id] = miner
 		}
-		miners[id] = miner
 	}
 
 	for id, miner := range miners {
@@ -942,20 +1239,30 @@ func convertMinersStats(window int64, raw *redis.ZSliceCmd) (int64, map[string]M
 	return totalHashrate, miners
 }
 
+func convertPayeesResults(raw *redis.ZSliceCmd) []*Payee {
+	var result []*Payee
+	for _, v := range raw.Val() {
+		result = append(result, &Payee{Login: v.Member.(string), Balance: int64(v.Score)})
+	}
+	return result
+}
+
 func convertPaymentsResults(raw *redis.ZSliceCmd) []map[string]interface{} {
 	var result []map[string]interface{}
 	for _, v := range raw.Val() {
+		row, err := parsePaymentRow(v.Member.(string))
+		if err != nil {
+			log.Printf("Skipping payment at %v: %v", int64(v.Score), err)
+			continue
+		}
 		tx := make(map[string]interface{})
 		tx["timestamp"] = int64(v.Score)
-		fields := strings.Split(v.Member.(string), ":")
-		tx["tx"] = fields[0]
+		tx["tx"] = row.Tx
 		// Individual or whole payments row
-		if len(fields) < 3 {
-			tx["amount"], _ = strconv.ParseInt(fields[1], 10, 64)
-		} else {
-			tx["address"] = fields[1]
-			tx["amount"], _ = strconv.ParseInt(fields[2], 10, 64)
+		if len(row.Address) > 0 {
+			tx["address"] = row.Address
 		}
+		tx["amount"] = row.Amount
 		result = append(result, tx)
 	}
 	return result
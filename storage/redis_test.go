@@ -0,0 +1,303 @@
+package storage
+
+import (
+	"math/big"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/maoxs2/ergoPool/rpc"
+	"gopkg.in/redis.v3"
+)
+
+// Tests run against real Redis at REDIS_TEST_ENDPOINT or local default, keys go under unique prefix
+func newTestClient(t *testing.T) *RedisClient {
+	endpoint := os.Getenv("REDIS_TEST_ENDPOINT")
+	if len(endpoint) == 0 {
+		endpoint = "127.0.0.1:6379"
+	}
+	prefix := "ergopooltest" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	r := NewRedisClient(&Config{Endpoint: endpoint, PoolSize: 4}, prefix)
+	if _, err := r.Check(); err != nil {
+		r.Close()
+		t.Skipf("Redis is not available at %s: %v", endpoint, err)
+	}
+	return r
+}
+
+func closeTestClient(r *RedisClient) {
+	var c int64
+	for {
+		var keys []string
+		var err error
+		c, keys, err = r.client.Scan(c, r.prefix+":*", 100).Result()
+		if err != nil {
+			break
+		}
+		if len(keys) > 0 {
+			r.client.Del(keys...)
+		}
+		if c == 0 {
+			break
+		}
+	}
+	r.Close()
+}
+
+func TestIndexPayeesAfterUnlockerCredit(t *testing.T) {
+	r := newTestClient(t)
+	defer closeTestClient(r)
+
+	// Balance credited before payees index existed
+	if err := r.client.HSet(r.formatKey("miners", "old"), "balance", "1500").Err(); err != nil {
+		t.Fatal(err)
+	}
+	r.client.HSet(r.formatKey("miners", "empty"), "balance", "0")
+
+	// Unlocker runs first and creates index with its own credit only
+	block := &BlockData{Height: 100, RoundHeight: 100, Hash: "h100", Reward: big.NewInt(3000)}
+	if err := r.WriteMaturedBlock(block, map[string]int64{"old": 500, "new": 2500}); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := r.IndexPayees()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("indexed %v payees, want 2", n)
+	}
+	payees, err := r.GetPayees(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"old": 2000, "new": 2500}
+	if len(payees) != len(want) {
+		t.Fatalf("got payees %v, want %v", payees, want)
+	}
+	for _, v := range payees {
+		if want[v.Login] != v.Balance {
+			t.Errorf("payee %s indexed with %v, want %v", v.Login, v.Balance, want[v.Login])
+		}
+	}
+
+	// Backfill runs once, later balances are indexed by updates
+	r.client.HSet(r.formatKey("miners", "later"), "balance", "100")
+	if n, err := r.IndexPayees(); err != nil || n != 0 {
+		t.Errorf("second backfill indexed %v payees: %v", n, err)
+	}
+}
+
+// Steady 1000 shares per second since long ago, now is in the middle of a bucket
+func steadyBuckets(now, window int64, ids ...string) []hashrateBucketData {
+	first := now - window
+	first -= first % hashrateBucket
+	var buckets []hashrateBucketData
+	for ts := first; ts <= now; ts += hashrateBucket {
+		elapsed := int64(hashrateBucket)
+		if now-ts < elapsed {
+			elapsed = now - ts
+		}
+		bucket := hashrateBucketData{ts: ts, shares: make(map[string]string)}
+		for _, id := range ids {
+			bucket.shares[id] = strconv.FormatInt(1000*elapsed, 10)
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets
+}
+
+func TestHashrateWindowEdge(t *testing.T) {
+	now := int64(1000*hashrateBucket + 30)
+	const smallWindow, largeWindow = 300, 600
+
+	total, miners := convertMinersStats(now, largeWindow, steadyBuckets(now, largeWindow, "miner1", "miner2"))
+	for id, miner := range miners {
+		if miner.HR != 1000 {
+			t.Errorf("%s hashrate %v, want 1000", id, miner.HR)
+		}
+	}
+	if total != 2000 {
+		t.Errorf("pool hashrate %v, want 2000", total)
+	}
+
+	workers := convertWorkersStats(now, smallWindow, largeWindow, steadyBuckets(now, largeWindow, "rig1", "rig2"))
+	for id, worker := range workers {
+		if worker.HR != 1000*smallWindow {
+			t.Errorf("%s shares in small window %v, want %v", id, worker.HR, 1000*smallWindow)
+		}
+		if worker.TotalHR != 1000*largeWindow {
+			t.Errorf("%s shares in large window %v, want %v", id, worker.TotalHR, 1000*largeWindow)
+		}
+	}
+}
+
+func TestFlushLegacyHashrate(t *testing.T) {
+	r := newTestClient(t)
+	defer closeTestClient(r)
+
+	r.client.ZAdd(r.formatKey("hashrate"), redis.Z{Score: 1, Member: "1000:miner1:rig1:1"})
+	r.client.ZAdd(r.formatKey("hashrate", "miner1"), redis.Z{Score: 1, Member: "1000:rig1:1"}, redis.Z{Score: 2, Member: "1000:rig1:2"})
+	bucket := r.formatKey("hashrate", "miner1", int64(60))
+	r.client.HSet(bucket, "rig1", "1000")
+
+	total, err := r.FlushStaleStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 {
+		t.Errorf("flushed %v legacy shares, want 3", total)
+	}
+	for _, key := range []string{r.formatKey("hashrate"), r.formatKey("hashrate", "miner1")} {
+		if exist, _ := r.client.Exists(key).Result(); exist {
+			t.Errorf("legacy %s is left", key)
+		}
+	}
+	if exist, _ := r.client.Exists(bucket).Result(); !exist {
+		t.Error("hashrate bucket was deleted")
+	}
+}
+
+func testBlockShare(login string, diff int64, solo bool) *Share {
+	return &Share{
+		Id:        login + "-block",
+		Login:     login,
+		Worker:    "rig1",
+		Params:    &rpc.SolutionReq{PK: "pk", N: "nonce", D: big.NewInt(7)},
+		Diff:      diff,
+		RoundDiff: big.NewInt(1000),
+		Height:    500,
+		Header:    "header-" + login,
+		Nodes:     []string{"main"},
+		Solo:      solo,
+		Timestamp: 1600000000123,
+	}
+}
+
+// Scripts address KEYS and ARGV by position, layout must match their doc comments
+func TestBlockScriptArgs(t *testing.T) {
+	r := &RedisClient{prefix: "test"}
+	tests := []struct {
+		solo   bool
+		script *redis.Script
+		keys   []string
+	}{
+		{false, writeBlockScript, []string{"test:shares:roundCurrent", "test:shares:round500:header-miner1", "test:stats",
+			"test:finders", "test:miners:miner1", "test:hashrate:pool:1599999960", "test:hashrate:miner1:1599999960",
+			"test:journal", "test:blocks:candidates"}},
+		{true, writeSoloBlockScript, []string{"test:miners:miner1", "test:shares:round500:header-miner1", "test:stats",
+			"test:finders", "test:hashrate:pool:1599999960", "test:hashrate:miner1:1599999960",
+			"test:journal", "test:blocks:candidates"}},
+	}
+	for _, tt := range tests {
+		share := testBlockShare("miner1", 50, tt.solo)
+		script, keys, args := r.blockScript(share, time.Hour)
+		if script != tt.script {
+			t.Errorf("solo %v: wrong script", tt.solo)
+		}
+		if len(keys) != len(tt.keys) {
+			t.Fatalf("solo %v: keys %v, want %v", tt.solo, keys, tt.keys)
+		}
+		for i := range keys {
+			if keys[i] != tt.keys[i] {
+				t.Errorf("solo %v: KEYS[%v] is %v, want %v", tt.solo, i+1, keys[i], tt.keys[i])
+			}
+		}
+
+		want := []string{"miner1", "rig1", "50", "1600000000", "3600", "500", "", share.Id, "1600000000123"}
+		if len(args) != len(want) {
+			t.Fatalf("solo %v: args %v", tt.solo, args)
+		}
+		for i := range want {
+			if i != 6 && args[i] != want[i] {
+				t.Errorf("solo %v: ARGV[%v] is %v, want %v", tt.solo, i+1, args[i], want[i])
+			}
+		}
+		row, err := parseCandidateRow(appendRoundShares(args[6], 150))
+		if err != nil {
+			t.Fatalf("solo %v: can't parse row prefix %s: %v", tt.solo, args[6], err)
+		}
+		if row.PK != "pk" || row.N != "nonce" || row.D != "7" || row.Header != share.Header ||
+			row.Timestamp != 1600000000 || row.Difficulty.Int64() != 1000 || row.TotalShares != 150 ||
+			row.Solo != tt.solo || len(row.Nodes) != 1 {
+			t.Errorf("solo %v: parsed row %+v", tt.solo, row)
+		}
+		if tt.solo && row.Finder != "miner1" || !tt.solo && row.Finder != "" {
+			t.Errorf("solo %v: finder %q", tt.solo, row.Finder)
+		}
+	}
+}
+
+func TestWriteBlock(t *testing.T) {
+	r := newTestClient(t)
+	defer closeTestClient(r)
+
+	r.client.HSet(r.formatKey("shares", "roundCurrent"), "miner2", "100")
+	r.client.HSet(r.formatKey("miners", "miner3"), "soloShares", "30")
+
+	pool := testBlockShare("miner1", 50, false)
+	if _, err := r.WriteBlock(pool, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	r.client.HSet(r.formatKey("shares", "roundCurrent"), "miner2", "10")
+	solo := testBlockShare("miner3", 20, true)
+	if _, err := r.WriteBlock(solo, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	candidates, err := r.GetCandidates(500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 2 {
+		t.Fatalf("got %v candidates, want 2", len(candidates))
+	}
+	for _, block := range candidates {
+		if block.Height != 500 || block.PK != "pk" || block.D != "7" || block.Difficulty.Int64() != 1000 {
+			t.Errorf("candidate %+v", block)
+		}
+		shares, err := r.GetRoundShares(500, block.Header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want map[string]int64
+		if block.Solo {
+			if block.Finder != "miner3" || block.TotalShares != 50 {
+				t.Errorf("solo candidate finder %q with %v shares, want miner3 with 50", block.Finder, block.TotalShares)
+			}
+			want = map[string]int64{"miner3": 50}
+		} else {
+			if block.Header != pool.Header || block.TotalShares != 150 {
+				t.Errorf("pool candidate %v with %v shares, want %v with 150", block.Header, block.TotalShares, pool.Header)
+			}
+			want = map[string]int64{"miner1": 50, "miner2": 100}
+		}
+		if len(shares) != len(want) {
+			t.Errorf("round %v shares %v, want %v", block.Header, shares, want)
+		}
+		for login, n := range want {
+			if shares[login] != n {
+				t.Errorf("round %v shares %v, want %v", block.Header, shares, want)
+			}
+		}
+	}
+
+	// Solo block leaves pool round running and resets finder's solo shares
+	current, _ := r.client.HGetAllMap(r.formatKey("shares", "roundCurrent")).Result()
+	if len(current) != 1 || current["miner2"] != "10" {
+		t.Errorf("current round %v after solo block", current)
+	}
+	if r.client.HExists(r.formatKey("miners", "miner3"), "soloShares").Val() {
+		t.Error("solo shares kept after solo block")
+	}
+	for _, share := range []*Share{pool, solo} {
+		if ok, err := r.IsShareWritten(share.Id); err != nil || !ok {
+			t.Errorf("share %v is not journaled: %v", share.Id, err)
+		}
+		blocks, _ := r.client.HGet(r.formatKey("miners", share.Login), "blocksFound").Result()
+		if blocks != "1" {
+			t.Errorf("%v has %v blocks found", share.Login, blocks)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"strconv"
+	"strings"
+
+	"gopkg.in/redis.v3"
+)
+
+// Returns up to limit matured and orphaned blocks which matured before given unix time and still
+// have round shares, in height order. Blocks are read after the height of last purged round, so
+// already purged ones are not read again. Rows matured before maturity time was recorded are
+// checked by block timestamp.
+func (r *RedisClient) GetExpiredRounds(before, limit int64) ([]*BlockData, error) {
+	purged, err := r.client.HGet(r.formatKey("retention"), "roundsHeight").Int64()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	option := redis.ZRangeByScore{Min: "(" + strconv.FormatInt(purged, 10), Max: "+inf", Count: limit}
+	cmd := r.client.ZRangeByScoreWithScores(r.formatKey("blocks", "matured"), option)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	var blocks []*BlockData
+	for _, block := range convertBlockResults(cmd) {
+		maturedAt := block.MaturedAt
+		if maturedAt == 0 {
+			maturedAt = block.Timestamp
+		}
+		// Blocks mature in height order, the rest is not expired either
+		if maturedAt >= before {
+			break
+		}
+		blocks = append(blocks, block)
+	}
+
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		for _, block := range blocks {
+			tx.Exists(r.formatRound(block.RoundHeight, block.RoundId()))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result []*BlockData
+	skipped := int64(0)
+	for i, cmd := range cmds {
+		if cmd.(*redis.BoolCmd).Val() {
+			result = append(result, blocks[i])
+		} else if len(result) == 0 {
+			skipped = blocks[i].Height
+		}
+	}
+	// Leading blocks have nothing to purge, e.g. rounds deleted on maturity
+	if skipped > 0 {
+		err = r.setPurgedRoundsHeight(skipped)
+	}
+	return result, err
+}
+
+// Deletes round shares, rounds must be purged in height order
+func (r *RedisClient) PurgeRound(block *BlockData) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		tx.Del(r.formatRound(block.RoundHeight, block.RoundId()))
+		tx.HSet(r.formatKey("retention"), "roundsHeight", strconv.FormatInt(block.Height, 10))
+		return nil
+	})
+	return err
+}
+
+func (r *RedisClient) setPurgedRoundsHeight(height int64) error {
+	return r.client.HSet(r.formatKey("retention"), "roundsHeight", strconv.FormatInt(height, 10)).Err()
+}
+
+// Trims every payments list to keep most recent rows only, returns number of removed rows
+func (r *RedisClient) CompactPayments(keep int64, dryRun bool) (int64, error) {
+	var c int64
+	total := int64(0)
+	for {
+		var keys []string
+		var err error
+		c, keys, err = r.client.Scan(c, r.formatKey("payments", "*"), 100).Result()
+		if err != nil {
+			return total, err
+		}
+		for _, key := range keys {
+			name := strings.TrimPrefix(key, r.formatKey("payments")+":")
+			if name == "pending" || name == "lock" {
+				continue
+			}
+			n, err := r.client.ZCard(key).Result()
+			if err != nil {
+				return total, err
+			}
+			if n <= keep {
+				continue
+			}
+			if !dryRun {
+				err = r.client.ZRemRangeByRank(key, 0, n-keep-1).Err()
+				if err != nil {
+					return total, err
+				}
+			}
+			total += n - keep
+		}
+		if c == 0 {
+			break
+		}
+	}
+	return total, nil
+}
+
+// Returns miners without balance of any kind and without shares since given unix time
+func (r *RedisClient) GetInactiveMiners(before int64) ([]string, error) {
+	var c int64
+	var result []string
+	for {
+		var keys []string
+		var err error
+		c, keys, err = r.client.Scan(c, r.formatKey("miners", "*"), 100).Result()
+		if err != nil {
+			return result, err
+		}
+		for _, key := range keys {
+			fields, err := r.client.HMGet(key, "lastShare", "balance", "immature", "pending").Result()
+			if err != nil {
+				return result, err
+			}
+			values := make([]int64, len(fields))
+			for i, v := range fields {
+				if s, ok := v.(string); ok {
+					values[i], _ = strconv.ParseInt(s, 10, 64)
+				}
+			}
+			if values[0] >= before || values[1] != 0 || values[2] != 0 || values[3] != 0 {
+				continue
+			}
+			result = append(result, strings.TrimPrefix(key, r.formatKey("miners")+":"))
+		}
+		if c == 0 {
+			break
+		}
+	}
+	return result, nil
+}
+
+// Deletes miner only if it is still inactive, returns false if it got balance or shares meanwhile
+func (r *RedisClient) DeleteMiner(login string, before int64) (bool, error) {
+	keys := []string{r.formatKey("miners", login), r.formatKey("payees")}
+	args := []string{login, strconv.FormatInt(before, 10)}
+	deleted, err := deleteMinerScript.Run(r.client, keys, args).Result()
+	if err != nil {
+		return false, err
+	}
+	n, _ := deleted.(int64)
+	return n > 0, nil
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"math/big"
+	"strconv"
+	"testing"
+
+	"gopkg.in/redis.v3"
+)
+
+func writeMaturedTestBlock(r *RedisClient, height, maturedAt int64) *BlockData {
+	block := &BlockData{
+		Height:      height,
+		RoundHeight: height,
+		Hash:        "h" + strconv.FormatInt(height, 10),
+		Header:      "m" + strconv.FormatInt(height, 10),
+		Reward:      big.NewInt(1000),
+		MaturedAt:   maturedAt,
+	}
+	r.client.HSet(r.formatRound(height, block.RoundId()), "miner1", "10")
+	r.client.ZAdd(r.formatKey("blocks", "matured"), redis.Z{Score: float64(height), Member: block.key()})
+	return block
+}
+
+func TestMaturedBlockRoundShares(t *testing.T) {
+	r := newTestClient(t)
+	defer closeTestClient(r)
+
+	for _, keep := range []bool{false, true} {
+		r.SetKeepRoundShares(keep)
+		height := int64(100)
+		if keep {
+			height = 200
+		}
+		block := &BlockData{Height: height, RoundHeight: height, Hash: "h", Header: "m", Reward: big.NewInt(1000)}
+		r.client.HSet(r.formatRound(height, block.RoundId()), "miner1", "10")
+		if err := r.WriteMaturedBlock(block, map[string]int64{"miner1": 1000}); err != nil {
+			t.Fatal(err)
+		}
+		exist, _ := r.client.Exists(r.formatRound(height, block.RoundId())).Result()
+		if exist != keep {
+			t.Errorf("with keepRoundShares %v round shares exist: %v", keep, exist)
+		}
+	}
+}
+
+func TestGetExpiredRounds(t *testing.T) {
+	r := newTestClient(t)
+	defer closeTestClient(r)
+
+	for h := int64(1); h <= 5; h++ {
+		writeMaturedTestBlock(r, h, 1000+h)
+	}
+	// Round deleted on maturity, nothing to purge
+	r.client.Del(r.formatRound(1, "m1"))
+	writeMaturedTestBlock(r, 6, 5000)
+
+	blocks, err := r.GetExpiredRounds(2000, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 || blocks[0].Height != 2 || blocks[1].Height != 3 {
+		t.Fatalf("got %v expired rounds, want heights 2 and 3", len(blocks))
+	}
+	for _, block := range blocks {
+		if err := r.PurgeRound(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Purged ones are not read again, not expired block stops the scan
+	blocks, err = r.GetExpiredRounds(2000, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 || blocks[0].Height != 4 || blocks[1].Height != 5 {
+		t.Fatalf("got %v expired rounds, want heights 4 and 5", len(blocks))
+	}
+}
+
+func TestDeleteMiner(t *testing.T) {
+	r := newTestClient(t)
+	defer closeTestClient(r)
+
+	r.client.HSet(r.formatKey("miners", "idle"), "lastShare", "100")
+	r.client.HSet(r.formatKey("miners", "credited"), "lastShare", "100")
+	r.client.HSet(r.formatKey("miners", "credited"), "balance", "5")
+	r.client.HSet(r.formatKey("miners", "back"), "lastShare", "300")
+
+	for login, want := range map[string]bool{"idle": true, "credited": false, "back": false} {
+		deleted, err := r.DeleteMiner(login, 200)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != want {
+			t.Errorf("miner %s deleted: %v, want %v", login, deleted, want)
+		}
+		exist, _ := r.client.Exists(r.formatKey("miners", login)).Result()
+		if exist == want {
+			t.Errorf("miner %s exists: %v", login, exist)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Block and payment rows are stored as versioned JSON objects. Fields may be added
+// without bumping version, parsers ignore unknown fields and keep defaults for missing ones.
+// Rows written before JSON encoding are colon-joined strings and still parsed.
+const rowVersion = 1
+
+type candidateRow struct {
+	Version     int      `json:"v"`
+	PK          string   `json:"pk"`
+	W           string   `json:"w"`
+	N           string   `json:"n"`
+	D           string   `json:"d"`
+	Header      string   `json:"header,omitempty"`
+	Timestamp   int64    `json:"ts"`
+	Difficulty  *big.Int `json:"diff"`
+	Nodes       []string `json:"nodes,omitempty"`
+	Solo        bool     `json:"solo,omitempty"`
+	Finder      string   `json:"finder,omitempty"`
+	TotalShares int64    `json:"shares,omitempty"`
+}
+
+// Open JSON object without total shares, they are only known once round is rotated
+func (c *candidateRow) prefix() string {
+	row := *c
+	row.Version = rowVersion
+	row.TotalShares = 0
+	data, _ := json.Marshal(&row)
+	return strings.TrimSuffix(string(data), "}")
+}
+
+func (c *candidateRow) String() string {
+	return c.prefix() + `,"shares":` + strconv.FormatInt(c.TotalShares, 10) + "}"
+}
+
+func parseCandidateRow(s string) (*candidateRow, error) {
+	row := &candidateRow{}
+	if isJSONRow(s) {
+		return row, json.Unmarshal([]byte(s), row)
+	}
+	// Legacy "PK:W:N:D:timestamp:diff:totalShares"
+	fields := strings.Split(s, ":")
+	if len(fields) != 7 {
+		return nil, fmt.Errorf("malformed candidate row %q", s)
+	}
+	row.PK, row.W, row.N, row.D = fields[0], fields[1], fields[2], fields[3]
+	var err error
+	if row.Timestamp, err = strconv.ParseInt(fields[4], 10, 64); err != nil {
+		return nil, fmt.Errorf("malformed candidate timestamp: %v", err)
+	}
+	if row.Difficulty, err = parseDifficulty(fields[5]); err != nil {
+		return nil, fmt.Errorf("malformed candidate difficulty: %v", err)
+	}
+	if row.TotalShares, err = strconv.ParseInt(fields[6], 10, 64); err != nil {
+		return nil, fmt.Errorf("malformed candidate shares: %v", err)
+	}
+	return row, nil
+}
+
+type blockRow struct {
+	Version     int      `json:"v"`
+	UncleHeight int64    `json:"uncleHeight,omitempty"`
+	Orphan      bool     `json:"orphan,omitempty"`
+	PK          string   `json:"pk"`
+	Hash        string   `json:"hash"`
+	Header      string   `json:"header,omitempty"`
+	Timestamp   int64    `json:"ts"`
+	Difficulty  *big.Int `json:"diff"`
+	TotalShares int64    `json:"shares"`
+	Reward      string   `json:"reward"`
+	MaturedAt   int64    `json:"maturedAt,omitempty"`
+	Solo        bool     `json:"solo,omitempty"`
+	Finder      string   `json:"finder,omitempty"`
+}
+
+func (b *blockRow) String() string {
+	row := *b
+	row.Version = rowVersion
+	data, _ := json.Marshal(&row)
+	return string(data)
+}
+
+func parseBlockRow(s string) (*blockRow, error) {
+	row := &blockRow{}
+	if isJSONRow(s) {
+		return row, json.Unmarshal([]byte(s), row)
+	}
+	// Legacy "uncleHeight:orphan:PK:blockHash:timestamp:diff:totalShares:reward"
+	fields := strings.Split(s, ":")
+	if len(fields) != 8 {
+		return nil, fmt.Errorf("malformed block row %q", s)
+	}
+	row.UncleHeight, _ = strconv.ParseInt(fields[0], 10, 64)
+	row.Orphan, _ = strconv.ParseBool(fields[1])
+	row.PK = fields[2]
+	row.Hash = fields[3]
+	row.Timestamp, _ = strconv.ParseInt(fields[4], 10, 64)
+	row.Difficulty, _ = parseDifficulty(fields[5])
+	row.TotalShares, _ = strconv.ParseInt(fields[6], 10, 64)
+	row.Reward = fields[7]
+	return row, nil
+}
+
+// Address is only set for pool-wide payments list
+type paymentRow struct {
+	Version int    `json:"v"`
+	Tx      string `json:"tx"`
+	Address string `json:"address,omitempty"`
+	Amount  int64  `json:"amount"`
+}
+
+func (p *paymentRow) String() string {
+	row := *p
+	row.Version = rowVersion
+	data, _ := json.Marshal(&row)
+	return string(data)
+}
+
+func parsePaymentRow(s string) (*paymentRow, error) {
+	row := &paymentRow{}
+	if isJSONRow(s) {
+		return row, json.Unmarshal([]byte(s), row)
+	}
+	// Legacy "txHash:amount" or "txHash:address:amount"
+	fields := strings.Split(s, ":")
+	switch len(fields) {
+	case 2:
+		row.Tx = fields[0]
+		row.Amount, _ = strconv.ParseInt(fields[1], 10, 64)
+	case 3:
+		row.Tx = fields[0]
+		row.Address = fields[1]
+		row.Amount, _ = strconv.ParseInt(fields[2], 10, 64)
+	default:
+		return nil, fmt.Errorf("malformed payment row %q", s)
+	}
+	return row, nil
+}
+
+// Network difficulty doesn't fit int64, it is kept as exact decimal
+func parseDifficulty(s string) (*big.Int, error) {
+	diff, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid difficulty %q", s)
+	}
+	return diff, nil
+}
+
+func isJSONRow(s string) bool {
+	return strings.HasPrefix(s, "{")
+}
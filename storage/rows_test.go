@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"math/big"
+	"strconv"
+	"testing"
+)
+
+// Same as writeBlockScript appending total shares to row prefix
+func appendRoundShares(prefix string, total int64) string {
+	return prefix + `,"shares":` + strconv.FormatFloat(float64(total), 'f', 0, 64) + "}"
+}
+
+func bigDiff(s string) *big.Int {
+	diff, _ := new(big.Int).SetString(s, 10)
+	return diff
+}
+
+func TestCandidateRowShares(t *testing.T) {
+	tests := []struct {
+		name  string
+		row   candidateRow
+		total int64
+	}{
+		{"minimal", candidateRow{PK: "pk", W: "w", N: "n", D: "d", Timestamp: 1, Difficulty: big.NewInt(1)}, 1},
+		{"optional fields", candidateRow{PK: "pk", W: "w", N: "n", D: "d", Header: "m", Timestamp: 1600000000,
+			Difficulty: big.NewInt(2000000000), Nodes: []string{"main", "backup"}, Solo: true, Finder: "rig1"}, 123456},
+		{"no round shares", candidateRow{PK: "pk", Timestamp: 1, Difficulty: big.NewInt(1)}, 0},
+		{"difficulty over int64", candidateRow{PK: "pk", Timestamp: 1, Difficulty: bigDiff("1813006236221440000000")}, 1 << 40},
+		{"difficulty over float64 precision", candidateRow{PK: "pk", Timestamp: 1, Difficulty: bigDiff("340282366920938463463374607431768211457")}, 7},
+		// Set before round was rotated, replaced by appended total
+		{"stale total", candidateRow{PK: "pk", Timestamp: 1, Difficulty: big.NewInt(1), TotalShares: 99}, 5},
+	}
+	for _, tt := range tests {
+		s := appendRoundShares(tt.row.prefix(), tt.total)
+		row, err := parseCandidateRow(s)
+		if err != nil {
+			t.Errorf("%s: can't parse %s: %v", tt.name, s, err)
+			continue
+		}
+		if row.Version != rowVersion {
+			t.Errorf("%s: version %v, want %v", tt.name, row.Version, rowVersion)
+		}
+		if row.TotalShares != tt.total {
+			t.Errorf("%s: total shares %v, want %v", tt.name, row.TotalShares, tt.total)
+		}
+		if row.Difficulty.Cmp(tt.row.Difficulty) != 0 {
+			t.Errorf("%s: difficulty %v, want %v", tt.name, row.Difficulty, tt.row.Difficulty)
+		}
+		if row.PK != tt.row.PK || row.W != tt.row.W || row.N != tt.row.N || row.D != tt.row.D ||
+			row.Header != tt.row.Header || row.Timestamp != tt.row.Timestamp ||
+			row.Solo != tt.row.Solo || row.Finder != tt.row.Finder || len(row.Nodes) != len(tt.row.Nodes) {
+			t.Errorf("%s: parsed %+v from %s", tt.name, row, s)
+		}
+
+		// Rows of finished rounds are written as a whole, both forms must match
+		full := tt.row
+		full.TotalShares = tt.total
+		if full.String() != s {
+			t.Errorf("%s: row %s, appended %s", tt.name, full.String(), s)
+		}
+	}
+}
+
+func TestCandidateRowPrefix(t *testing.T) {
+	row := &candidateRow{PK: "pk", Timestamp: 1, Difficulty: big.NewInt(1), Nodes: []string{"main"}, TotalShares: 10}
+	prefix := row.prefix()
+	if prefix[len(prefix)-1] == '}' {
+		t.Fatalf("prefix %s is closed", prefix)
+	}
+	parsed, err := parseCandidateRow(prefix + "}")
+	if err != nil {
+		t.Fatalf("can't parse closed prefix %s: %v", prefix, err)
+	}
+	if parsed.TotalShares != 0 {
+		t.Errorf("prefix keeps total shares %v", parsed.TotalShares)
+	}
+}
+
+func TestParseLegacyRows(t *testing.T) {
+	candidate, err := parseCandidateRow("pk:w:n:d:1600000000:1813006236221440000000:500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if candidate.PK != "pk" || candidate.W != "w" || candidate.N != "n" || candidate.D != "d" ||
+		candidate.Timestamp != 1600000000 || candidate.TotalShares != 500 ||
+		candidate.Difficulty.Cmp(bigDiff("1813006236221440000000")) != 0 {
+		t.Errorf("parsed legacy candidate %+v", candidate)
+	}
+
+	block, err := parseBlockRow("0:true:pk:hash:1600000000:1813006236221440000000:500:67500000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.UncleHeight != 0 || !block.Orphan || block.PK != "pk" || block.Hash != "hash" ||
+		block.Timestamp != 1600000000 || block.TotalShares != 500 || block.Reward != "67500000000" ||
+		block.Difficulty.Cmp(bigDiff("1813006236221440000000")) != 0 {
+		t.Errorf("parsed legacy block %+v", block)
+	}
+
+	payment, err := parsePaymentRow("tx:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.Tx != "tx" || payment.Address != "" || payment.Amount != 1000 {
+		t.Errorf("parsed legacy miner payment %+v", payment)
+	}
+	payment, err = parsePaymentRow("tx:9fRWULXtir5FyBkdU4Z9Ux5RDKXDpbKaTyk7ihSXQg4TmqkW8vE:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.Tx != "tx" || payment.Address != "9fRWULXtir5FyBkdU4Z9Ux5RDKXDpbKaTyk7ihSXQg4TmqkW8vE" || payment.Amount != 1000 {
+		t.Errorf("parsed legacy pool payment %+v", payment)
+	}
+
+	for _, s := range []string{"pk:w:n:d:1:1", "pk:w:n:d:ts:1:1", "pk:w:n:d:1:x:1"} {
+		if _, err := parseCandidateRow(s); err == nil {
+			t.Errorf("malformed candidate %q is parsed", s)
+		}
+	}
+	if _, err := parseBlockRow("0:false:pk:hash:1:1:1"); err == nil {
+		t.Error("malformed block is parsed")
+	}
+	if _, err := parsePaymentRow("tx"); err == nil {
+		t.Error("malformed payment is parsed")
+	}
+}
+
+func TestRowsRoundTrip(t *testing.T) {
+	block := &blockRow{UncleHeight: 1, Orphan: true, PK: "pk", Hash: "hash", Header: "m", Timestamp: 1600000000,
+		Difficulty: bigDiff("1813006236221440000000"), TotalShares: 500, Reward: "67500000000",
+		MaturedAt: 1600001000, Solo: true, Finder: "rig1"}
+	parsedBlock, err := parseBlockRow(block.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsedBlock.Version != rowVersion {
+		t.Errorf("block version %v, want %v", parsedBlock.Version, rowVersion)
+	}
+	parsedBlock.Version = 0
+	if parsedBlock.Difficulty.Cmp(block.Difficulty) != 0 {
+		t.Errorf("block difficulty %v, want %v", parsedBlock.Difficulty, block.Difficulty)
+	}
+	parsedBlock.Difficulty = block.Difficulty
+	if *parsedBlock != *block {
+		t.Errorf("parsed block %+v, want %+v", parsedBlock, block)
+	}
+
+	for _, payment := range []*paymentRow{{Tx: "tx", Amount: 1000}, {Tx: "tx", Address: "addr", Amount: 1000}} {
+		parsed, err := parsePaymentRow(payment.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.Version != rowVersion {
+			t.Errorf("payment version %v, want %v", parsed.Version, rowVersion)
+		}
+		parsed.Version = 0
+		if *parsed != *payment {
+			t.Errorf("parsed payment %+v, want %+v", parsed, payment)
+		}
+	}
+
+	// Newer rows may carry fields this version doesn't know
+	parsedBlock, err = parseBlockRow(`{"v":2,"pk":"pk","hash":"hash","ts":1,"diff":5,"shares":1,"reward":"1","extra":true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsedBlock.Hash != "hash" || parsedBlock.Difficulty.Int64() != 5 {
+		t.Errorf("parsed newer block %+v", parsedBlock)
+	}
+}
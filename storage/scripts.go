@@ -0,0 +1,133 @@
+package storage
+
+import "gopkg.in/redis.v3"
+
+// Records found block in one step: credits the finder's share the same way writeShare does,
+// rotates current round into round key, sums round shares and inserts block candidate.
+// Candidate row is passed as JSON object without closing brace, total shares are appended here.
+//
+// KEYS: roundCurrent, round, stats, finders, miner, pool bucket, miner bucket, journal, candidates
+// ARGV: login, worker, diff, ts, expire, height, row, share id, ms
+var writeBlockScript = redis.NewScript(`
+local login, worker, diff, ts = ARGV[1], ARGV[2], ARGV[3], ARGV[4]
+
+redis.call('HINCRBY', KEYS[1], login, diff)
+redis.call('HINCRBY', KEYS[6], login, diff)
+redis.call('EXPIRE', KEYS[6], ARGV[5])
+redis.call('HINCRBY', KEYS[7], worker, diff)
+redis.call('EXPIRE', KEYS[7], ARGV[5])
+redis.call('HSET', KEYS[5], 'lastShare', ts)
+if ARGV[8] ~= '' then
+	redis.call('ZADD', KEYS[8], ARGV[9], ARGV[8])
+end
+
+redis.call('HSET', KEYS[3], 'lastBlockFound', ts)
+redis.call('HDEL', KEYS[3], 'roundShares')
+redis.call('ZINCRBY', KEYS[4], 1, login)
+redis.call('HINCRBY', KEYS[5], 'blocksFound', 1)
+redis.call('RENAME', KEYS[1], KEYS[2])
+
+local total = 0
+for _, v in ipairs(redis.call('HVALS', KEYS[2])) do
+	total = total + tonumber(v)
+end
+local row = ARGV[7] .. ',"shares":' .. string.format('%.0f', total) .. '}'
+redis.call('ZADD', KEYS[9], ARGV[6], row)
+return row
+`)
+
+// Records block found by solo miner. Pool round is left as is, round key gets the finder's
+// solo shares only, so the whole reward goes to the finder.
+//
+// KEYS: miner, round, stats, finders, pool bucket, miner bucket, journal, candidates
+// ARGV: login, worker, diff, ts, expire, height, row, share id, ms
+var writeSoloBlockScript = redis.NewScript(`
+local login, worker, diff, ts = ARGV[1], ARGV[2], ARGV[3], ARGV[4]
+
+redis.call('HINCRBY', KEYS[5], login, diff)
+redis.call('EXPIRE', KEYS[5], ARGV[5])
+redis.call('HINCRBY', KEYS[6], worker, diff)
+redis.call('EXPIRE', KEYS[6], ARGV[5])
+redis.call('HSET', KEYS[1], 'lastShare', ts)
+if ARGV[8] ~= '' then
+	redis.call('ZADD', KEYS[7], ARGV[9], ARGV[8])
+end
+
+local total = redis.call('HINCRBY', KEYS[1], 'soloShares', diff)
+redis.call('HDEL', KEYS[1], 'soloShares')
+redis.call('HSET', KEYS[1], 'lastSoloBlockFound', ts)
+redis.call('HSET', KEYS[3], 'lastSoloBlockFound', ts)
+redis.call('ZINCRBY', KEYS[4], 1, login)
+redis.call('HINCRBY', KEYS[1], 'blocksFound', 1)
+redis.call('HSET', KEYS[2], login, total)
+
+local row = ARGV[7] .. ',"shares":' .. string.format('%.0f', total) .. '}'
+redis.call('ZADD', KEYS[8], ARGV[6], row)
+return row
+`)
+
+// Sets payee score to current balance, so backfill can't overwrite concurrent credit with stale balance.
+//
+// KEYS: miner, payees
+// ARGV: login
+var indexPayeeScript = redis.NewScript(`
+local balance = tonumber(redis.call('HGET', KEYS[1], 'balance') or '0')
+if balance <= 0 then
+	return 0
+end
+redis.call('ZADD', KEYS[2], balance, ARGV[1])
+return 1
+`)
+
+// Deletes miner if it still has no balance of any kind and no shares since given time,
+// checked and deleted at once so credit arriving meanwhile is never lost.
+//
+// KEYS: miner, payees
+// ARGV: login, before
+var deleteMinerScript = redis.NewScript(`
+local fields = redis.call('HMGET', KEYS[1], 'lastShare', 'balance', 'immature', 'pending')
+if (tonumber(fields[1]) or 0) >= tonumber(ARGV[2]) then
+	return 0
+end
+for i = 2, 4 do
+	if (tonumber(fields[i]) or 0) ~= 0 then
+		return 0
+	end
+end
+redis.call('DEL', KEYS[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+return 1
+`)
+
+// Rewrites whole ERG amounts of a hash in nanoERG by appending nine zeros, so big amounts stay exact.
+// Hash is marked in done set at once, it is never scaled twice by concurrent migrations.
+// Payee score follows scaled balance.
+//
+// KEYS: hash, done, payees
+// ARGV: login (empty for non-miner hash), fields... (every field if none)
+var scaleNanoErgScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[2], KEYS[1]) == 1 then
+	return 0
+end
+local fields = {}
+for i = 2, #ARGV do
+	fields[#fields + 1] = ARGV[i]
+end
+if #fields == 0 then
+	fields = redis.call('HKEYS', KEYS[1])
+end
+for _, field in ipairs(fields) do
+	local value = redis.call('HGET', KEYS[1], field)
+	if value and value ~= '0' and string.match(value, '^%-?%d+$') then
+		redis.call('HSET', KEYS[1], field, value .. '000000000')
+	end
+end
+if ARGV[1] ~= '' and redis.call('ZSCORE', KEYS[3], ARGV[1]) then
+	local balance = redis.call('HGET', KEYS[1], 'balance')
+	if balance then
+		redis.call('ZADD', KEYS[3], balance, ARGV[1])
+	end
+end
+redis.call('HSET', KEYS[2], KEYS[1], 1)
+return 1
+`)
@@ -10,8 +10,8 @@ import (
 	"github.com/ethereum/go-ethereum/common/math"
 )
 
-var Ether = math.BigPow(10, 18)
-var Shannon = math.BigPow(10, 9)
+// nanoERG in one ERG
+var Erg = math.BigPow(10, 9)
 
 var pow256 = math.BigPow(2, 256)
 var addressPattern = regexp.MustCompile("^0x[0-9a-fA-F]{40}$")
@@ -52,8 +52,8 @@ func FormatReward(reward *big.Int) string {
 }
 
 func FormatRatReward(reward *big.Rat) string {
-	wei := new(big.Rat).SetInt(Ether)
-	reward = reward.Quo(reward, wei)
+	erg := new(big.Rat).SetInt(Erg)
+	reward = new(big.Rat).Quo(reward, erg)
 	return reward.FloatString(8)
 }
 
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/maoxs2/ergoPool/ergo"
+	"github.com/maoxs2/ergoPool/payouts"
+	"github.com/maoxs2/ergoPool/policy"
+	"github.com/maoxs2/ergoPool/proxy"
+)
+
+// Problems are collected as "json.path: message", so all of them are reported at once
+type configProblems struct {
+	list      []string
+	network   ergo.NetworkType
+	networkOk bool
+}
+
+func (p *configProblems) add(path, format string, args ...interface{}) {
+	p.list = append(p.list, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (p *configProblems) duration(path, value string, optional bool) {
+	if len(value) == 0 {
+		if !optional {
+			p.add(path, "duration is required")
+		}
+		return
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		p.add(path, "invalid duration %q", value)
+	} else if d <= 0 {
+		p.add(path, "duration must be positive")
+	}
+}
+
+func (p *configProblems) address(path, value string) {
+	if len(value) == 0 || !p.networkOk {
+		return
+	}
+	if err := p.network.ValidateAddress(value); err != nil {
+		p.add(path, "%v", err)
+	}
+}
+
+func (p *configProblems) daemonUrl(path, value string) {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		p.add(path, "invalid node url %q", value)
+	}
+}
+
+func (p *configProblems) fee(path string, value float64) {
+	if value < 0 || value > 100 {
+		p.add(path, "fee must be between 0 and 100 percent")
+	}
+}
+
+// Checks config of enabled modules as they would check it on start
+func validateConfig(cfg *proxy.Config) []string {
+	p := &configProblems{}
+	network, err := ergo.ParseNetwork(cfg.Network)
+	if err != nil {
+		p.add("network", "%v", err)
+	} else {
+		p.network, p.networkOk = network, true
+	}
+	if len(cfg.Redis.Endpoint) == 0 {
+		p.add("redis.endpoint", "is required")
+	}
+	if cfg.Proxy.Enabled {
+		validateProxy(p, cfg)
+	}
+	if cfg.Api.Enabled {
+		validateApi(p, cfg)
+	}
+	if cfg.BlockUnlocker.Enabled {
+		validateUnlocker(p, &cfg.BlockUnlocker)
+		retention := &cfg.Api.Retention
+		if cfg.Api.Enabled && retention.Enabled && len(retention.RoundShares) > 0 && !cfg.BlockUnlocker.KeepRoundShares {
+			p.add("unlocker.keepRoundShares", "must be set for api.retention.roundShares, otherwise round shares are deleted on maturity")
+		}
+	}
+	if cfg.Payouts.Enabled {
+		validatePayouts(p, &cfg.Payouts)
+	}
+	validateListeners(p, cfg)
+	return p.list
+}
+
+func validateProxy(p *configProblems, cfg *proxy.Config) {
+	c := &cfg.Proxy
+	if len(cfg.Name) == 0 {
+		p.add("name", "instance name is required")
+	}
+	p.duration("proxy.blockRefreshInterval", c.BlockRefreshInterval, false)
+	p.duration("proxy.longPollTimeout", c.LongPollTimeout, true)
+	p.duration("proxy.stateUpdateInterval", c.StateUpdateInterval, false)
+	p.duration("proxy.hashrateExpiration", c.HashrateExpiration, false)
+	p.duration("upstreamCheckInterval", cfg.UpstreamCheckInterval, false)
+	if c.LimitBodySize <= 0 {
+		p.add("proxy.limitBodySize", "must be positive")
+	}
+
+	if c.Difficulty <= 0 {
+		p.add("proxy.difficulty", "must be positive")
+	}
+	if c.MinDifficulty < 0 {
+		p.add("proxy.minDifficulty", "can't be negative")
+	}
+	minDiff := c.MinDifficulty
+	if minDiff <= 0 {
+		minDiff = c.Difficulty
+	}
+	maxDiff := c.MaxDifficulty
+	if maxDiff <= 0 {
+		maxDiff = c.Difficulty
+	}
+	if c.MaxDifficulty < 0 {
+		p.add("proxy.maxDifficulty", "can't be negative")
+	} else if maxDiff < minDiff {
+		p.add("proxy.maxDifficulty", "must not be lower than minimal share difficulty %v", minDiff)
+	}
+	if p.networkOk {
+		if _, err := proxy.PoolMiningPK(c, p.network); err != nil {
+			p.add("proxy.miningAddress", "%v", err)
+		}
+	}
+
+	if len(cfg.Upstream) == 0 {
+		p.add("upstream", "at least one upstream is required")
+	}
+	names := make(map[string]bool)
+	for i, v := range cfg.Upstream {
+		path := fmt.Sprintf("upstream[%d]", i)
+		if len(v.Name) == 0 {
+			p.add(path+".name", "is required")
+		} else if names[v.Name] {
+			p.add(path+".name", "duplicate upstream name %s", v.Name)
+		}
+		names[v.Name] = true
+		p.daemonUrl(path+".url", v.Url)
+		p.duration(path+".timeout", v.Timeout, false)
+	}
+	if cfg.UpstreamMaxLag < 0 {
+		p.add("upstreamMaxLag", "can't be negative")
+	}
+	if cfg.UpstreamSwitchChecks < 0 {
+		p.add("upstreamSwitchChecks", "can't be negative")
+	}
+
+	pc := &c.Policy
+	if pc.Workers <= 0 {
+		p.add("proxy.policy.workers", "must be positive")
+	}
+	if pc.IPv6Prefix < 0 || pc.IPv6Prefix > 128 {
+		p.add("proxy.policy.ipv6Prefix", "must be between 0 and 128")
+	}
+	p.duration("proxy.policy.resetInterval", pc.ResetInterval, false)
+	p.duration("proxy.policy.refreshInterval", pc.RefreshInterval, false)
+	p.duration("proxy.policy.limits.grace", pc.Limits.Grace, false)
+	p.duration("proxy.policy.banning.offenseWindow", pc.Banning.OffenseWindow, true)
+	if pc.Banning.EscalationFactor > 1 && len(pc.Banning.OffenseWindow) == 0 {
+		p.add("proxy.policy.banning.offenseWindow", "is required when escalationFactor is above 1")
+	}
+	if err := policy.ValidateBanning(&pc.Banning); err != nil {
+		p.add("proxy.policy.banning.backend", "%v", err)
+	}
+	if pc.Banning.InvalidPercent < 0 || pc.Banning.InvalidPercent > 100 {
+		p.add("proxy.policy.banning.invalidPercent", "must be between 0 and 100")
+	}
+
+	if c.Journal.Enabled {
+		if len(c.Journal.Path) == 0 {
+			p.add("proxy.journal.path", "is required")
+		}
+		p.duration("proxy.journal.replayInterval", c.Journal.ReplayInterval, false)
+		p.duration("proxy.journal.dedupWindow", c.Journal.DedupWindow, false)
+	}
+}
+
+func validateApi(p *configProblems, cfg *proxy.Config) {
+	c := &cfg.Api
+	p.duration("api.statsCollectInterval", c.StatsCollectInterval, false)
+	p.duration("api.purgeInterval", c.PurgeInterval, false)
+	p.duration("api.hashrateWindow", c.HashrateWindow, false)
+	p.duration("api.hashrateLargeWindow", c.HashrateLargeWindow, false)
+	for i, v := range c.LuckWindow {
+		if v <= 0 {
+			p.add(fmt.Sprintf("api.luckWindow[%d]", i), "must be positive")
+		}
+	}
+	if c.Retention.Enabled {
+		p.duration("api.retention.roundShares", c.Retention.RoundShares, true)
+		p.duration("api.retention.inactiveMiners", c.Retention.InactiveMiners, true)
+	}
+}
+
+func validateUnlocker(p *configProblems, c *payouts.UnlockerConfig) {
+	p.fee("unlocker.poolFee", c.PoolFee)
+	p.fee("unlocker.soloFee", c.SoloFee)
+	p.address("unlocker.poolFeeAddress", c.PoolFeeAddress)
+	if p.networkOk && c.Depth < p.network.RewardDelay() {
+		p.add("unlocker.depth", "can't be < %v, rewards are locked that long on %s", p.network.RewardDelay(), p.network)
+	}
+	if c.ImmatureDepth < payouts.MinImmatureDepth {
+		p.add("unlocker.immatureDepth", "can't be < %v", payouts.MinImmatureDepth)
+	} else if c.ImmatureDepth >= c.Depth {
+		p.add("unlocker.immatureDepth", "must be lower than depth %v", c.Depth)
+	}
+	p.duration("unlocker.interval", c.Interval, false)
+	p.duration("unlocker.timeout", c.Timeout, false)
+	p.daemonUrl("unlocker.daemon", c.Daemon)
+}
+
+func validatePayouts(p *configProblems, c *payouts.PayoutsConfig) {
+	p.address("payouts.address", c.Address)
+	if c.Fee < ergo.MinTxFee {
+		p.add("payouts.fee", "can't be < %v nanoERG", ergo.MinTxFee)
+	}
+	if c.Threshold <= 0 {
+		p.add("payouts.threshold", "must be positive")
+	}
+	if c.RequirePeers < 0 {
+		p.add("payouts.requirePeers", "can't be negative")
+	}
+	p.duration("payouts.interval", c.Interval, false)
+	p.duration("payouts.timeout", c.Timeout, false)
+	p.daemonUrl("payouts.daemon", c.Daemon)
+}
+
+type listener struct {
+	path string
+	host string
+	port string
+}
+
+// Listeners conflict on same port unless both are bound to different specific hosts
+func validateListeners(p *configProblems, cfg *proxy.Config) {
+	var listeners []listener
+	add := func(path, addr string) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			p.add(path, "invalid listen address %q", addr)
+			return
+		}
+		l := listener{path: path, host: host, port: port}
+		for _, other := range listeners {
+			if l.port == other.port && (l.host == other.host || isAnyHost(l.host) || isAnyHost(other.host)) {
+				p.add(path, "conflicts with %s on port %s", other.path, port)
+			}
+		}
+		listeners = append(listeners, l)
+	}
+	if cfg.Proxy.Enabled {
+		add("proxy.listen", cfg.Proxy.Listen)
+		if cfg.Proxy.Stratum.Enabled {
+			add("proxy.stratum.listen", cfg.Proxy.Stratum.Listen)
+		}
+	}
+	if cfg.Api.Enabled && !cfg.Api.PurgeOnly {
+		add("api.listen", cfg.Api.Listen)
+		if len(cfg.Api.AdminListen) > 0 {
+			add("api.adminListen", cfg.Api.AdminListen)
+		}
+	}
+}
+
+func isAnyHost(host string) bool {
+	return len(host) == 0 || host == "0.0.0.0" || host == "::"
+}